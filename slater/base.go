@@ -32,8 +32,14 @@ package slater
 import (
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/drnp/slater/slater/engine"
 	"github.com/drnp/slater/slater/runtime/config"
@@ -48,13 +54,16 @@ var logger *log.Logger
 
 // Conf : Iniial configuration
 type Conf struct {
-	CustomConf map[string]interface{}
-	Game       string
-	Standalone bool
-	OnConnect  transmitter.OnConnectHandler
-	OnClose    transmitter.OnCloseHandler
-	OnData     transmitter.OnDataHandler
-	OnMessage  transmitter.OnMessageHandler
+	CustomConf   map[string]interface{}
+	Game         string
+	Standalone   bool
+	Serializers  map[byte]engine.Serializer
+	Authenticate transmitter.AuthenticateHandler
+	OnConnect    transmitter.OnConnectHandler
+	OnClose      transmitter.OnCloseHandler
+	OnData       transmitter.OnDataHandler
+	OnMessage    transmitter.OnMessageHandler
+	Middlewares  []transmitter.Middleware
 }
 
 // Start : Slater startup
@@ -80,19 +89,70 @@ func Start(c *Conf) (err error) {
 	// Start
 	//fmt.Printf("Start slater engine with game <%s> ...\n", c.Game)
 
+	// Message compression
+	engine.DefaultCompressMode, err = engine.CompressModeByName(config.GetString("compress_mode"))
+	if err != nil {
+		return err
+	}
+
+	engine.CompressThreshold = config.GetInt("compress_threshold")
+	engine.MaxBodyLength = uint32(config.GetInt("max_body_length"))
+
+	// Custom serializers
+	for t, serializer := range c.Serializers {
+		err = engine.RegisterSerializer(t, serializer)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Engine
 	engine.Start(logger)
 
-	// TCPServer
+	// Network server
 	if !c.Standalone {
-		s := transmitter.NewTCPServer(config.Get("server_addr").(string), transmitter.AccessRequest)
+		s, err := newServer(config.GetString("server_listener"), config.GetString("server_addr"))
+		if err != nil {
+			return err
+		}
+
+		// Behind load balancer
+		if config.GetBool("proxy_protocol") {
+			s.ProxyProtocol, err = transmitter.NewProxyProtocol(splitList(config.GetString("proxy_protocol_trusted")))
+			if err != nil {
+				return err
+			}
+		}
+
 		s.Waiter = &globalWaiter
+		s.RequireOnline = config.GetBool("require_online")
+		s.OnlineMaxFailures = config.GetInt("online_max_failures")
+		s.AckTimeout = time.Duration(config.GetInt("ack_timeout")) * time.Millisecond
+		s.AckRetries = config.GetInt("ack_retries")
+		s.IdleTimeout = time.Duration(config.GetInt("idle_timeout")) * time.Millisecond
+		s.HeartbeatTimeout = time.Duration(config.GetInt("heartbeat_timeout")) * time.Millisecond
+		s.PingInterval = time.Duration(config.GetInt("ping_interval")) * time.Millisecond
+
+		// Send queue
+		s.SendQueueSize = config.GetInt("send_queue_size")
+		s.SendQueueTimeout = time.Duration(config.GetInt("send_queue_timeout")) * time.Millisecond
+		s.SendQueuePolicy, err = transmitter.QueuePolicyByName(config.GetString("send_queue_policy"))
+		if err != nil {
+			return err
+		}
+
+		// Online handshake
+		if c.Authenticate != nil {
+			s.Authenticate = c.Authenticate
+		} else {
+			s.Authenticate = transmitter.DefaultAuthenticate
+		}
 
 		// Event : Connect
 		if c.OnConnect != nil {
 			s.OnConnect = c.OnConnect
 		} else {
-			s.OnClose = transmitter.DefaultOnConnect
+			s.OnConnect = transmitter.DefaultOnConnect
 		}
 
 		// Event : Close
@@ -116,11 +176,23 @@ func Start(c *Conf) (err error) {
 			s.OnMessage = transmitter.DefaultOnnMessage
 		}
 
+		// OnMessage middlewares
+		s.Middlewares = c.Middlewares
+
 		err = s.Start()
 		if err != nil {
 			//return err
 			panic(err)
 		}
+
+		// Graceful shutdown
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			sig := <-sigChan
+			fmt.Printf("Signal %s received, shutting down ...\n", sig)
+			s.Shutdown(time.Duration(config.GetInt("shutdown_timeout")) * time.Millisecond)
+		}()
 	}
 
 	globalWaiter.Wait()
@@ -130,6 +202,76 @@ func Start(c *Conf) (err error) {
 
 /* }}} */
 
+// newServer : Create server with listener selected by name
+/* {{{ [newServer] */
+func newServer(listener, addr string) (*transmitter.SlaterServer, error) {
+	switch strings.ToLower(listener) {
+	case "", "tcp":
+		return transmitter.NewTCPServer(addr, transmitter.AccessRequest), nil
+	case "tls":
+		tlsConfig, err := transmitter.LoadTLSConfig(
+			config.GetString("server_tls_cert"),
+			config.GetString("server_tls_key"),
+			config.GetString("server_tls_client_ca"))
+		if err != nil {
+			return nil, err
+		}
+
+		return transmitter.NewTLSServer(addr, transmitter.AccessRequest, tlsConfig), nil
+	case "unix":
+		opts := transmitter.UnixOptions{
+			UID: config.GetInt("server_unix_uid"),
+			GID: config.GetInt("server_unix_gid"),
+		}
+
+		mode, err := strconv.ParseUint(config.GetString("server_unix_mode"), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid server_unix_mode : %s", err)
+		}
+
+		opts.Mode = os.FileMode(mode)
+
+		return transmitter.NewUnixServer(config.GetString("server_unix_path"), transmitter.AccessRequest, opts), nil
+	case "websocket", "ws":
+		origins := splitList(config.GetString("server_ws_origins"))
+
+		return transmitter.NewWebSocketServer(addr, config.GetString("server_ws_path"), transmitter.AccessRequest, origins), nil
+	case "udp", "kcp":
+		opts := transmitter.UDPOptions{
+			NoDelay:      config.GetBool("server_udp_nodelay"),
+			Interval:     time.Duration(config.GetInt("server_udp_interval")) * time.Millisecond,
+			FastResend:   config.GetInt("server_udp_resend"),
+			NoCongestion: config.GetBool("server_udp_nc"),
+			SndWnd:       config.GetInt("server_udp_sndwnd"),
+			RcvWnd:       config.GetInt("server_udp_rcvwnd"),
+			MTU:          config.GetInt("server_udp_mtu"),
+			MaxSessions:  config.GetInt("server_udp_max_sessions"),
+			Timeout:      time.Duration(config.GetInt("server_udp_timeout")) * time.Millisecond,
+		}
+
+		return transmitter.NewUDPServer(addr, transmitter.AccessRequest, opts), nil
+	}
+
+	return nil, fmt.Errorf("Unsupported server listener [%s]", listener)
+}
+
+/* }}} */
+
+// splitList : Comma separated config value
+/* {{{ [splitList] */
+func splitList(value string) []string {
+	var ret []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+
+	return ret
+}
+
+/* }}} */
+
 /*
  * Local variables:
  * tab-width: 4
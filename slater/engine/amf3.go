@@ -0,0 +1,1090 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// AMF3 type markers
+const (
+	amf3Undefined    byte = 0x00
+	amf3Null         byte = 0x01
+	amf3False        byte = 0x02
+	amf3True         byte = 0x03
+	amf3Integer      byte = 0x04
+	amf3Double       byte = 0x05
+	amf3String       byte = 0x06
+	amf3XMLDoc       byte = 0x07
+	amf3Date         byte = 0x08
+	amf3Array        byte = 0x09
+	amf3Object       byte = 0x0A
+	amf3XML          byte = 0x0B
+	amf3ByteArray    byte = 0x0C
+	amf3VectorInt    byte = 0x0D
+	amf3VectorUint   byte = 0x0E
+	amf3VectorDouble byte = 0x0F
+	amf3VectorObject byte = 0x10
+	amf3Dictionary   byte = 0x11
+)
+
+const (
+	amf3IntMax = 0x0FFFFFFF
+	amf3IntMin = -0x10000000
+)
+
+// amf3MaxDepth : Max nesting level of arrays / objects / vectors / dictionaries
+const amf3MaxDepth = 64
+
+// AMF3Object : Typed (or sealed) AMF3 object
+// Anonymous dynamic objects are decoded as map[string]interface{}
+type AMF3Object struct {
+	Class   string
+	Dynamic bool
+	Sealed  []string
+	Members map[string]interface{}
+}
+
+// amf3Traits : Object traits
+type amf3Traits struct {
+	class   string
+	dynamic bool
+	sealed  []string
+}
+
+// amf3Encoder : AMF3 encoder with reference tables
+type amf3Encoder struct {
+	buf      bytes.Buffer
+	strings  map[string]int
+	objects  map[amf3ObjectKey]int
+	traits   map[string]int
+	nObjects int
+	depth    int
+}
+
+// amf3ObjectKey : Identity of encoded map / slice / pointer
+type amf3ObjectKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// amf3Decoder : AMF3 decoder with reference tables
+type amf3Decoder struct {
+	r       *bytes.Reader
+	strings []string
+	objects []interface{}
+	traits  []*amf3Traits
+	depth   int
+
+	// open : Indexes of containers still being decoded, references to
+	// them would build cyclic values
+	open map[int]struct{}
+}
+
+// AMF3Marshal : Encode value into AMF3 bytes
+/* {{{ [AMF3Marshal] */
+func AMF3Marshal(v interface{}) ([]byte, error) {
+	enc := &amf3Encoder{
+		strings: make(map[string]int),
+		objects: make(map[amf3ObjectKey]int),
+		traits:  make(map[string]int),
+	}
+
+	err := enc.writeValue(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.buf.Bytes(), nil
+}
+
+/* }}} */
+
+// AMF3Unmarshal : Decode AMF3 bytes into value
+// Integer -> int, Double -> float64, Object -> map[string]interface{} or
+// *AMF3Object, Array -> []interface{} (or map[string]interface{} with
+// associative part), Dictionary -> map[interface{}]interface{}
+/* {{{ [AMF3Unmarshal] */
+func AMF3Unmarshal(raw []byte) (interface{}, error) {
+	dec := &amf3Decoder{
+		r:    bytes.NewReader(raw),
+		open: make(map[int]struct{}),
+	}
+
+	return dec.readValue()
+}
+
+/* }}} */
+
+/* {{{ [amf3Encoder] */
+func (enc *amf3Encoder) writeU29(v uint32) {
+	v &= 0x1FFFFFFF
+	switch {
+	case v < 0x80:
+		enc.buf.WriteByte(byte(v))
+	case v < 0x4000:
+		enc.buf.WriteByte(byte(v>>7) | 0x80)
+		enc.buf.WriteByte(byte(v & 0x7F))
+	case v < 0x200000:
+		enc.buf.WriteByte(byte(v>>14) | 0x80)
+		enc.buf.WriteByte(byte(v>>7) | 0x80)
+		enc.buf.WriteByte(byte(v & 0x7F))
+	default:
+		enc.buf.WriteByte(byte(v>>22) | 0x80)
+		enc.buf.WriteByte(byte(v>>15) | 0x80)
+		enc.buf.WriteByte(byte(v>>8) | 0x80)
+		enc.buf.WriteByte(byte(v))
+	}
+}
+
+func (enc *amf3Encoder) writeDouble(f float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	enc.buf.Write(b[:])
+}
+
+func (enc *amf3Encoder) writeString(s string) {
+	if s == "" {
+		// Empty string never sent by reference
+		enc.writeU29(0x01)
+		return
+	}
+
+	if idx, ok := enc.strings[s]; ok {
+		enc.writeU29(uint32(idx << 1))
+		return
+	}
+
+	enc.strings[s] = len(enc.strings)
+	enc.writeU29(uint32(len(s)<<1 | 1))
+	enc.buf.WriteString(s)
+}
+
+func (enc *amf3Encoder) writeInt(i int64) {
+	if i >= amf3IntMin && i <= amf3IntMax {
+		enc.buf.WriteByte(amf3Integer)
+		enc.writeU29(uint32(i))
+	} else {
+		enc.buf.WriteByte(amf3Double)
+		enc.writeDouble(float64(i))
+	}
+}
+
+// writeReference : Write object reference if value already sent,
+// otherwise register it into object table
+func (enc *amf3Encoder) writeReference(v reflect.Value) bool {
+	var key amf3ObjectKey
+	switch v.Kind() {
+	case reflect.Map, reflect.Ptr, reflect.Slice:
+		if !v.IsNil() {
+			key.ptr = v.Pointer()
+			key.typ = v.Type()
+		}
+
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+	}
+
+	if key.ptr != 0 {
+		if idx, ok := enc.objects[key]; ok {
+			enc.writeU29(uint32(idx << 1))
+			return true
+		}
+
+		enc.objects[key] = enc.nObjects
+	}
+
+	enc.nObjects++
+
+	return false
+}
+
+func (enc *amf3Encoder) writeTraits(t *amf3Traits) {
+	key := fmt.Sprintf("%s|%v|%v", t.class, t.dynamic, t.sealed)
+	if idx, ok := enc.traits[key]; ok {
+		enc.writeU29(uint32(idx<<2 | 0x01))
+		return
+	}
+
+	enc.traits[key] = len(enc.traits)
+	flag := uint32(len(t.sealed)<<4 | 0x03)
+	if t.dynamic {
+		flag |= 0x08
+	}
+
+	enc.writeU29(flag)
+	enc.writeString(t.class)
+	for _, name := range t.sealed {
+		enc.writeString(name)
+	}
+}
+
+func (enc *amf3Encoder) writeValue(v reflect.Value) error {
+	enc.depth++
+	defer func() { enc.depth-- }()
+	if enc.depth > amf3MaxDepth {
+		return errors.New("AMF3 : value nested too deep")
+	}
+
+	for v.IsValid() && v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	if !v.IsValid() || (v.Kind() == reflect.Interface && v.IsNil()) {
+		enc.buf.WriteByte(amf3Null)
+		return nil
+	}
+
+	// Special types
+	switch val := v.Interface().(type) {
+	case time.Time:
+		enc.buf.WriteByte(amf3Date)
+		enc.nObjects++
+		enc.writeU29(0x01)
+		enc.writeDouble(float64(val.UnixNano() / int64(time.Millisecond)))
+		return nil
+	case AMF3Object:
+		return enc.writeObject(v, &val)
+	case *AMF3Object:
+		if val == nil {
+			enc.buf.WriteByte(amf3Null)
+			return nil
+		}
+
+		return enc.writeObject(v, val)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			enc.buf.WriteByte(amf3True)
+		} else {
+			enc.buf.WriteByte(amf3False)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		enc.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u <= amf3IntMax {
+			enc.writeInt(int64(u))
+		} else {
+			enc.buf.WriteByte(amf3Double)
+			enc.writeDouble(float64(u))
+		}
+	case reflect.Float32, reflect.Float64:
+		enc.buf.WriteByte(amf3Double)
+		enc.writeDouble(v.Float())
+	case reflect.String:
+		enc.buf.WriteByte(amf3String)
+		enc.writeString(v.String())
+	case reflect.Ptr:
+		if v.IsNil() {
+			enc.buf.WriteByte(amf3Null)
+			return nil
+		}
+
+		if _, ok := v.Elem().Interface().(time.Time); !ok && v.Elem().Kind() == reflect.Struct {
+			enc.buf.WriteByte(amf3Object)
+			if enc.writeReference(v) {
+				return nil
+			}
+
+			return enc.writeStruct(v.Elem())
+		}
+
+		return enc.writeValue(v.Elem())
+	case reflect.Slice, reflect.Array:
+		return enc.writeSlice(v)
+	case reflect.Map:
+		return enc.writeMap(v)
+	case reflect.Struct:
+		enc.buf.WriteByte(amf3Object)
+		enc.nObjects++
+		return enc.writeStruct(v)
+	default:
+		return fmt.Errorf("AMF3 : unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func (enc *amf3Encoder) writeSlice(v reflect.Value) error {
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		enc.buf.WriteByte(amf3Null)
+		return nil
+	}
+
+	n := v.Len()
+	switch v.Type().Elem().Kind() {
+	case reflect.Uint8:
+		enc.buf.WriteByte(amf3ByteArray)
+		if enc.writeReference(v) {
+			return nil
+		}
+
+		enc.writeU29(uint32(n<<1 | 1))
+		for i := 0; i < n; i++ {
+			enc.buf.WriteByte(byte(v.Index(i).Uint()))
+		}
+
+		return nil
+	case reflect.Int32:
+		enc.buf.WriteByte(amf3VectorInt)
+		if enc.writeReference(v) {
+			return nil
+		}
+
+		enc.writeU29(uint32(n<<1 | 1))
+		enc.buf.WriteByte(0)
+		for i := 0; i < n; i++ {
+			binary.Write(&enc.buf, binary.BigEndian, int32(v.Index(i).Int()))
+		}
+
+		return nil
+	case reflect.Uint32:
+		enc.buf.WriteByte(amf3VectorUint)
+		if enc.writeReference(v) {
+			return nil
+		}
+
+		enc.writeU29(uint32(n<<1 | 1))
+		enc.buf.WriteByte(0)
+		for i := 0; i < n; i++ {
+			binary.Write(&enc.buf, binary.BigEndian, uint32(v.Index(i).Uint()))
+		}
+
+		return nil
+	case reflect.Float64:
+		enc.buf.WriteByte(amf3VectorDouble)
+		if enc.writeReference(v) {
+			return nil
+		}
+
+		enc.writeU29(uint32(n<<1 | 1))
+		enc.buf.WriteByte(0)
+		for i := 0; i < n; i++ {
+			enc.writeDouble(v.Index(i).Float())
+		}
+
+		return nil
+	}
+
+	// Dense array
+	enc.buf.WriteByte(amf3Array)
+	if enc.writeReference(v) {
+		return nil
+	}
+
+	enc.writeU29(uint32(n<<1 | 1))
+	// No associative part
+	enc.writeString("")
+	for i := 0; i < n; i++ {
+		err := enc.writeValue(v.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (enc *amf3Encoder) writeMap(v reflect.Value) error {
+	if v.IsNil() {
+		enc.buf.WriteByte(amf3Null)
+		return nil
+	}
+
+	keys := v.MapKeys()
+	if v.Type().Key().Kind() == reflect.String {
+		// Anonymous dynamic object
+		enc.buf.WriteByte(amf3Object)
+		if enc.writeReference(v) {
+			return nil
+		}
+
+		enc.writeTraits(&amf3Traits{dynamic: true})
+		for _, key := range keys {
+			if key.String() == "" {
+				continue
+			}
+
+			enc.writeString(key.String())
+			err := enc.writeValue(v.MapIndex(key))
+			if err != nil {
+				return err
+			}
+		}
+
+		enc.writeString("")
+
+		return nil
+	}
+
+	// Dictionary
+	enc.buf.WriteByte(amf3Dictionary)
+	if enc.writeReference(v) {
+		return nil
+	}
+
+	enc.writeU29(uint32(len(keys)<<1 | 1))
+	// Strong keys
+	enc.buf.WriteByte(0)
+	for _, key := range keys {
+		err := enc.writeValue(key)
+		if err == nil {
+			err = enc.writeValue(v.MapIndex(key))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (enc *amf3Encoder) writeObject(v reflect.Value, obj *AMF3Object) error {
+	enc.buf.WriteByte(amf3Object)
+	if enc.writeReference(v) {
+		return nil
+	}
+
+	enc.writeTraits(&amf3Traits{
+		class:   obj.Class,
+		dynamic: obj.Dynamic,
+		sealed:  obj.Sealed,
+	})
+
+	sealed := make(map[string]bool)
+	for _, name := range obj.Sealed {
+		sealed[name] = true
+		err := enc.writeValue(reflect.ValueOf(obj.Members[name]))
+		if err != nil {
+			return err
+		}
+	}
+
+	if obj.Dynamic {
+		for name, member := range obj.Members {
+			if sealed[name] || name == "" {
+				continue
+			}
+
+			enc.writeString(name)
+			err := enc.writeValue(reflect.ValueOf(member))
+			if err != nil {
+				return err
+			}
+		}
+
+		enc.writeString("")
+	}
+
+	return nil
+}
+
+// writeStruct : Struct as anonymous dynamic object.
+// Exported fields are members, named by `amf` tag if given
+func (enc *amf3Encoder) writeStruct(v reflect.Value) error {
+	enc.writeTraits(&amf3Traits{dynamic: true})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("amf"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+
+			name = tag
+		}
+
+		enc.writeString(name)
+		err := enc.writeValue(v.Field(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	enc.writeString("")
+
+	return nil
+}
+
+/* }}} */
+
+/* {{{ [amf3Decoder] */
+func (dec *amf3Decoder) readU29() (uint32, error) {
+	var ret uint32
+	for i := 0; i < 4; i++ {
+		b, err := dec.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if i == 3 {
+			return ret<<8 | uint32(b), nil
+		}
+
+		ret = ret<<7 | uint32(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+func (dec *amf3Decoder) readDouble() (float64, error) {
+	var b [8]byte
+	_, err := io.ReadFull(dec.r, b[:])
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Float64frombits(binary.BigEndian.Uint64(b[:])), nil
+}
+
+func (dec *amf3Decoder) readBytes(n int) ([]byte, error) {
+	if n > dec.r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	b := make([]byte, n)
+	_, err := io.ReadFull(dec.r, b)
+
+	return b, err
+}
+
+func (dec *amf3Decoder) readString() (string, error) {
+	u, err := dec.readU29()
+	if err != nil {
+		return "", err
+	}
+
+	if u&1 == 0 {
+		idx := int(u >> 1)
+		if idx >= len(dec.strings) {
+			return "", errors.New("AMF3 : invalid string reference")
+		}
+
+		return dec.strings[idx], nil
+	}
+
+	b, err := dec.readBytes(int(u >> 1))
+	if err != nil {
+		return "", err
+	}
+
+	s := string(b)
+	if s != "" {
+		dec.strings = append(dec.strings, s)
+	}
+
+	return s, nil
+}
+
+// readReference : Return referenced object if the U29 is a reference,
+// otherwise the remaining value bits
+func (dec *amf3Decoder) readReference() (interface{}, uint32, bool, error) {
+	u, err := dec.readU29()
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if u&1 == 0 {
+		idx := int(u >> 1)
+		if idx >= len(dec.objects) {
+			return nil, 0, false, errors.New("AMF3 : invalid object reference")
+		}
+
+		if _, ok := dec.open[idx]; ok {
+			return nil, 0, false, errors.New("AMF3 : cyclic object reference")
+		}
+
+		return dec.objects[idx], 0, true, nil
+	}
+
+	return nil, u >> 1, false, nil
+}
+
+// openObject : Add container to reference table, kept open until the
+// returned function called
+func (dec *amf3Decoder) openObject(v interface{}) func() {
+	idx := len(dec.objects)
+	dec.objects = append(dec.objects, v)
+	dec.open[idx] = struct{}{}
+
+	return func() {
+		delete(dec.open, idx)
+	}
+}
+
+func (dec *amf3Decoder) readValue() (interface{}, error) {
+	marker, err := dec.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	dec.depth++
+	defer func() { dec.depth-- }()
+	if dec.depth > amf3MaxDepth {
+		return nil, errors.New("AMF3 : value nested too deep")
+	}
+
+	switch marker {
+	case amf3Undefined, amf3Null:
+		return nil, nil
+	case amf3False:
+		return false, nil
+	case amf3True:
+		return true, nil
+	case amf3Integer:
+		u, err := dec.readU29()
+		if err != nil {
+			return nil, err
+		}
+
+		i := int(u)
+		if u&0x10000000 != 0 {
+			// Sign extend
+			i -= 0x20000000
+		}
+
+		return i, nil
+	case amf3Double:
+		return dec.readDouble()
+	case amf3String:
+		return dec.readString()
+	case amf3XMLDoc, amf3XML:
+		ref, n, isRef, err := dec.readReference()
+		if err != nil || isRef {
+			return ref, err
+		}
+
+		b, err := dec.readBytes(int(n))
+		if err != nil {
+			return nil, err
+		}
+
+		dec.objects = append(dec.objects, string(b))
+
+		return string(b), nil
+	case amf3Date:
+		ref, _, isRef, err := dec.readReference()
+		if err != nil || isRef {
+			return ref, err
+		}
+
+		ms, err := dec.readDouble()
+		if err != nil {
+			return nil, err
+		}
+
+		t := time.Unix(0, int64(ms)*int64(time.Millisecond))
+		dec.objects = append(dec.objects, t)
+
+		return t, nil
+	case amf3Array:
+		return dec.readArray()
+	case amf3Object:
+		return dec.readObject()
+	case amf3ByteArray:
+		ref, n, isRef, err := dec.readReference()
+		if err != nil || isRef {
+			return ref, err
+		}
+
+		b, err := dec.readBytes(int(n))
+		if err != nil {
+			return nil, err
+		}
+
+		dec.objects = append(dec.objects, b)
+
+		return b, nil
+	case amf3VectorInt, amf3VectorUint, amf3VectorDouble, amf3VectorObject:
+		return dec.readVector(marker)
+	case amf3Dictionary:
+		return dec.readDictionary()
+	}
+
+	return nil, fmt.Errorf("AMF3 : unknown marker 0x%02X", marker)
+}
+
+func (dec *amf3Decoder) readArray() (interface{}, error) {
+	ref, n, isRef, err := dec.readReference()
+	if err != nil || isRef {
+		return ref, err
+	}
+
+	if int(n) > dec.r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	key, err := dec.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		// Dense only
+		ret := make([]interface{}, n)
+		defer dec.openObject(ret)()
+		for i := range ret {
+			ret[i], err = dec.readValue()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return ret, nil
+	}
+
+	// Associative part, dense elements keyed by index
+	ret := make(map[string]interface{})
+	defer dec.openObject(ret)()
+	for key != "" {
+		ret[key], err = dec.readValue()
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = dec.readString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < int(n); i++ {
+		ret[fmt.Sprintf("%d", i)], err = dec.readValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (dec *amf3Decoder) readObject() (interface{}, error) {
+	ref, u, isRef, err := dec.readReference()
+	if err != nil || isRef {
+		return ref, err
+	}
+
+	var traits *amf3Traits
+	if u&1 == 0 {
+		// Traits reference
+		idx := int(u >> 1)
+		if idx >= len(dec.traits) {
+			return nil, errors.New("AMF3 : invalid traits reference")
+		}
+
+		traits = dec.traits[idx]
+	} else if u&2 != 0 {
+		return nil, errors.New("AMF3 : externalizable objects not supported")
+	} else {
+		traits = &amf3Traits{
+			dynamic: u&4 != 0,
+		}
+
+		traits.class, err = dec.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		nSealed := int(u >> 3)
+		if nSealed > dec.r.Len() {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		for i := 0; i < nSealed; i++ {
+			name, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			traits.sealed = append(traits.sealed, name)
+		}
+
+		dec.traits = append(dec.traits, traits)
+	}
+
+	members := make(map[string]interface{})
+	var ret interface{} = members
+	if traits.class != "" || len(traits.sealed) > 0 {
+		ret = &AMF3Object{
+			Class:   traits.class,
+			Dynamic: traits.dynamic,
+			Sealed:  traits.sealed,
+			Members: members,
+		}
+	}
+
+	defer dec.openObject(ret)()
+	for _, name := range traits.sealed {
+		members[name], err = dec.readValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if traits.dynamic {
+		for {
+			name, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			if name == "" {
+				break
+			}
+
+			members[name], err = dec.readValue()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func (dec *amf3Decoder) readVector(marker byte) (interface{}, error) {
+	ref, n, isRef, err := dec.readReference()
+	if err != nil || isRef {
+		return ref, err
+	}
+
+	// Fixed flag
+	_, err = dec.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if int(n) > dec.r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	switch marker {
+	case amf3VectorInt:
+		ret := make([]int32, n)
+		err = binary.Read(dec.r, binary.BigEndian, ret)
+		dec.objects = append(dec.objects, ret)
+		return ret, err
+	case amf3VectorUint:
+		ret := make([]uint32, n)
+		err = binary.Read(dec.r, binary.BigEndian, ret)
+		dec.objects = append(dec.objects, ret)
+		return ret, err
+	case amf3VectorDouble:
+		ret := make([]float64, n)
+		err = binary.Read(dec.r, binary.BigEndian, ret)
+		dec.objects = append(dec.objects, ret)
+		return ret, err
+	}
+
+	// Object type name, not used
+	_, err = dec.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, n)
+	defer dec.openObject(ret)()
+	for i := range ret {
+		ret[i], err = dec.readValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (dec *amf3Decoder) readDictionary() (ret interface{}, err error) {
+	ref, n, isRef, err := dec.readReference()
+	if err != nil || isRef {
+		return ref, err
+	}
+
+	// Weak keys flag
+	_, err = dec.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if int(n) > dec.r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	dict := make(map[interface{}]interface{})
+	defer dec.openObject(dict)()
+	defer func() {
+		// Unhashable key (array or object)
+		if r := recover(); r != nil {
+			ret, err = nil, fmt.Errorf("AMF3 : invalid dictionary key : %v", r)
+		}
+	}()
+
+	for i := 0; i < int(n); i++ {
+		key, err := dec.readValue()
+		if err != nil {
+			return nil, err
+		}
+
+		dict[key], err = dec.readValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dict, nil
+}
+
+/* }}} */
+
+// amf3Members : Members of decoded AMF3 object
+func amf3Members(v interface{}) (map[string]interface{}, bool) {
+	switch obj := v.(type) {
+	case map[string]interface{}:
+		return obj, true
+	case *AMF3Object:
+		return obj.Members, true
+	}
+
+	return nil, false
+}
+
+// amf3Int64 : Numeric value of decoded AMF3 integer / double
+func amf3Int64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	}
+
+	return 0, false
+}
+
+// AMF3DecodeCommand : Decode AMF3 object into command
+/* {{{ [AMF3DecodeCommand] */
+func AMF3DecodeCommand(raw []byte, cmd *CommonCommand) error {
+	v, err := AMF3Unmarshal(raw)
+	if err != nil {
+		return err
+	}
+
+	members, ok := amf3Members(v)
+	if !ok {
+		return errors.New("AMF3 : command is not an object")
+	}
+
+	if n, ok := amf3Int64(members["Command"]); ok {
+		cmd.Command = int(n)
+	}
+
+	if params, ok := amf3Members(members["Params"]); ok {
+		cmd.Params = params
+	}
+
+	if additional, ok := amf3Members(members["Additional"]); ok {
+		cmd.Additional = make(map[string]string)
+		for key, value := range additional {
+			cmd.Additional[key] = fmt.Sprint(value)
+		}
+	}
+
+	return nil
+}
+
+/* }}} */
+
+// AMF3DecodeBody : Decode AMF3 object into message body
+/* {{{ [AMF3DecodeBody] */
+func AMF3DecodeBody(raw []byte, body *Body) error {
+	v, err := AMF3Unmarshal(raw)
+	if err != nil {
+		return err
+	}
+
+	members, ok := amf3Members(v)
+	if !ok {
+		return errors.New("AMF3 : body is not an object")
+	}
+
+	body.App, _ = members["App"].(string)
+	switch uids := members["UID"].(type) {
+	case []interface{}:
+		for _, uid := range uids {
+			if n, ok := amf3Int64(uid); ok {
+				body.UID = append(body.UID, n)
+			}
+		}
+	case []float64:
+		for _, uid := range uids {
+			body.UID = append(body.UID, int64(uid))
+		}
+	case []int32:
+		for _, uid := range uids {
+			body.UID = append(body.UID, int64(uid))
+		}
+	}
+
+	body.Payload, _ = members["Payload"].([]byte)
+
+	return nil
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+/* {{{ [TestAMF3RoundTrip] */
+func TestAMF3RoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		in   interface{}
+		out  interface{}
+	}{
+		{"null", nil, nil},
+		{"true", true, true},
+		{"int", 12345, 12345},
+		{"negative", -7, -7},
+		{"double", 1.5, 1.5},
+		{"string", "slater", "slater"},
+		{"array", []interface{}{1, "a", false}, []interface{}{1, "a", false}},
+		{"object", map[string]interface{}{"k": "v"}, map[string]interface{}{"k": "v"}},
+	}
+
+	for _, c := range cases {
+		raw, err := AMF3Marshal(c.in)
+		if err != nil {
+			t.Fatalf("%s : marshal : %s", c.name, err)
+		}
+
+		v, err := AMF3Unmarshal(raw)
+		if err != nil {
+			t.Fatalf("%s : unmarshal : %s", c.name, err)
+		}
+
+		if !reflect.DeepEqual(v, c.out) {
+			t.Errorf("%s : got %#v, want %#v", c.name, v, c.out)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestAMF3Depth] */
+func TestAMF3Depth(t *testing.T) {
+	nested := func(n int) []byte {
+		// Dense array of one element : 09 03 01 (empty associative part)
+		raw := bytes.Repeat([]byte{amf3Array, 0x03, 0x01}, n)
+
+		return append(raw, amf3Null)
+	}
+
+	cases := []struct {
+		name  string
+		depth int
+		fail  bool
+	}{
+		{"shallow", 8, false},
+		{"limit", amf3MaxDepth - 1, false},
+		{"too deep", amf3MaxDepth, true},
+		{"very deep", 100000, true},
+	}
+
+	for _, c := range cases {
+		_, err := AMF3Unmarshal(nested(c.depth))
+		if c.fail != (err != nil) {
+			t.Errorf("%s : unexpected error %v", c.name, err)
+		}
+	}
+
+	var v interface{}
+	for i := 0; i < amf3MaxDepth+1; i++ {
+		v = []interface{}{v}
+	}
+
+	if _, err := AMF3Marshal(v); err == nil {
+		t.Error("marshal : nesting limit not enforced")
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestAMF3Cycle] */
+func TestAMF3Cycle(t *testing.T) {
+	// Dynamic anonymous object with one member, then end of members
+	object := func(name string, value ...byte) []byte {
+		raw := []byte{amf3Object, 0x0B, 0x01, byte(len(name)<<1 | 1)}
+		raw = append(raw, name...)
+		raw = append(raw, value...)
+
+		return append(raw, 0x01)
+	}
+
+	// Additional referencing Params decoded before, not a cycle
+	shared := []byte{amf3Object, 0x0B, 0x01, 0x0D}
+	shared = append(shared, "Params"...)
+	shared = append(shared, amf3Object, 0x0B, 0x01, 0x01, 0x15)
+	shared = append(shared, "Additional"...)
+	shared = append(shared, amf3Object, 0x02, 0x01)
+
+	cases := []struct {
+		name string
+		raw  []byte
+		fail bool
+	}{
+		{"self additional", object("Additional", amf3Object, 0x00), true},
+		{"self params", object("Params", amf3Object, 0x00), true},
+		{"nested params", object("Params", object("Inner", amf3Object, 0x00)...), true},
+		{"self array", []byte{amf3Array, 0x03, 0x01, amf3Array, 0x00}, true},
+		{"shared params", shared, false},
+	}
+
+	for _, c := range cases {
+		_, err := CmdDecode(c.raw, MsgSerializeAMF3)
+		if c.fail != (err != nil) {
+			t.Errorf("%s : unexpected error %v", c.name, err)
+		}
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -29,11 +29,7 @@
 
 package engine
 
-import (
-	"errors"
-
-	"github.com/ugorji/go/codec"
-)
+import "errors"
 
 // CommonCommand : Common command
 type CommonCommand struct {
@@ -50,32 +46,12 @@ func (cmd *CommonCommand) ToRaw() []byte {
 // Encode : Encode command struct into bytes
 /* {{{ [Encode] Encode command */
 func (cmd *CommonCommand) Encode(t byte) ([]byte, error) {
-	var (
-		ret []byte
-		err error
-	)
-
-	switch t {
-	case MsgSerializeMsgPack:
-		var hdl codec.MsgpackHandle
-		hdl.EncodeOptions.StructToArray = true
-		enc := codec.NewEncoderBytes(&ret, &hdl)
-		err = enc.Encode(cmd)
-		break
-	case MsgSerializeJSON:
-		var hdl codec.JsonHandle
-		enc := codec.NewEncoderBytes(&ret, &hdl)
-		err = enc.Encode(cmd)
-		break
-	case MsgSerializeAMF3:
-		break
-	case MsgSerializeRaw:
-	default:
-		ret = nil
-		break
+	s := GetSerializer(t)
+	if s == nil {
+		return nil, errors.New("Unsupported serialize mode")
 	}
 
-	return ret, err
+	return s.EncodeCommand(cmd)
 }
 
 /* }}} */
@@ -87,28 +63,14 @@ func CmdDecode(raw []byte, t byte) (*CommonCommand, error) {
 		return nil, errors.New("Invalid stream")
 	}
 
-	var (
-		ret CommonCommand
-		err error
-	)
-
-	switch t {
-	case MsgSerializeMsgPack:
-		var hdl codec.MsgpackHandle
-		dec := codec.NewDecoderBytes(raw, &hdl)
-		err = dec.Decode(&ret)
-		break
-	case MsgSerializeJSON:
-		var hdl codec.JsonHandle
-		dec := codec.NewDecoderBytes(raw, &hdl)
-		err = dec.Decode(&ret)
-		break
-	case MsgSerializeAMF3:
-		break
-	case MsgSerializeRaw:
-	default:
-		break
+	s := GetSerializer(t)
+	if s == nil {
+		return nil, errors.New("Unsupported serialize mode")
 	}
+
+	var ret CommonCommand
+	err := s.DecodeCommand(raw, &ret)
+
 	return &ret, err
 }
 
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+)
+
+// DefaultCompressMode : Compress mode of new created messages
+var DefaultCompressMode = MsgCompressNone
+
+// CompressThreshold : Bodies shorter than threshold (bytes) will be sent
+// without compression even if a compress mode was set
+var CompressThreshold = 256
+
+// CompressModeByName : Get compress mode from name
+// (none / deflate / snappy / lz4)
+/* {{{ [CompressModeByName] */
+func CompressModeByName(name string) (byte, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return MsgCompressNone, nil
+	case "deflate":
+		return MsgCompressDeflate, nil
+	case "snappy":
+		return MsgCompressSnappy, nil
+	case "lz4":
+		return MsgCompressLZ4, nil
+	}
+
+	return MsgCompressNone, errors.New("Unsupported compress mode")
+}
+
+/* }}} */
+
+// Compress : Compress raw data
+/* {{{ [Compress] */
+func Compress(raw []byte, mode byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch mode {
+	case MsgCompressNone:
+		return raw, nil
+	case MsgCompressDeflate:
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = w.Write(raw)
+		if err == nil {
+			err = w.Close()
+		}
+
+		return buf.Bytes(), err
+	case MsgCompressSnappy:
+		return snappy.Encode(nil, raw), nil
+	case MsgCompressLZ4:
+		w := lz4.NewWriter(&buf)
+		_, err := w.Write(raw)
+		if err == nil {
+			err = w.Close()
+		}
+
+		return buf.Bytes(), err
+	}
+
+	return nil, errors.New("Unsupported compress mode")
+}
+
+/* }}} */
+
+// Decompress : Decompress data, result is limited by MaxBodyLength
+/* {{{ [Decompress] */
+func Decompress(data []byte, mode byte) ([]byte, error) {
+	switch mode {
+	case MsgCompressNone:
+		return data, nil
+	case MsgCompressDeflate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+
+		return readLimited(r)
+	case MsgCompressSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if MaxBodyLength > 0 && uint32(n) > MaxBodyLength {
+			return nil, errDecompressedTooLarge
+		}
+
+		return snappy.Decode(nil, data)
+	case MsgCompressLZ4:
+		r := lz4.NewReader(bytes.NewReader(data))
+
+		return readLimited(r)
+	}
+
+	return nil, errors.New("Unsupported compress mode")
+}
+
+/* }}} */
+
+var errDecompressedTooLarge = errors.New("Decompressed body too large")
+
+// readLimited : Read all decompressed data, no more than MaxBodyLength
+/* {{{ [readLimited] */
+func readLimited(r io.Reader) ([]byte, error) {
+	if MaxBodyLength > 0 {
+		r = io.LimitReader(r, int64(MaxBodyLength)+1)
+	}
+
+	ret, err := ioutil.ReadAll(r)
+	if err == nil && MaxBodyLength > 0 && uint32(len(ret)) > MaxBodyLength {
+		return nil, errDecompressedTooLarge
+	}
+
+	return ret, err
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"bytes"
+	"testing"
+)
+
+/* {{{ [TestCompressRoundTrip] */
+func TestCompressRoundTrip(t *testing.T) {
+	raw := bytes.Repeat([]byte("slater compress "), 1024)
+	cases := []struct {
+		name string
+		mode byte
+	}{
+		{"none", MsgCompressNone},
+		{"deflate", MsgCompressDeflate},
+		{"snappy", MsgCompressSnappy},
+		{"lz4", MsgCompressLZ4},
+	}
+
+	for _, c := range cases {
+		mode, err := CompressModeByName(c.name)
+		if err != nil || mode != c.mode {
+			t.Errorf("%s : mode %d, error %v", c.name, mode, err)
+		}
+
+		data, err := Compress(raw, c.mode)
+		if err != nil {
+			t.Fatalf("%s : compress : %s", c.name, err)
+		}
+
+		if c.mode != MsgCompressNone && len(data) >= len(raw) {
+			t.Errorf("%s : not compressed, %d bytes", c.name, len(data))
+		}
+
+		ret, err := Decompress(data, c.mode)
+		if err != nil {
+			t.Fatalf("%s : decompress : %s", c.name, err)
+		}
+
+		if !bytes.Equal(ret, raw) {
+			t.Errorf("%s : round trip mismatch", c.name)
+		}
+	}
+
+	if _, err := CompressModeByName("zstd"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+
+	if _, err := Decompress(raw, 9); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestDecompressLimit] */
+func TestDecompressLimit(t *testing.T) {
+	defer func(n uint32) { MaxBodyLength = n }(MaxBodyLength)
+	MaxBodyLength = 64 * 1024
+
+	// Highly compressible bomb, decompressed size exceeds the limit
+	bomb := make([]byte, 4*1024*1024)
+	for _, mode := range []byte{MsgCompressDeflate, MsgCompressSnappy, MsgCompressLZ4} {
+		data, err := Compress(bomb, mode)
+		if err != nil {
+			t.Fatalf("mode %d : compress : %s", mode, err)
+		}
+
+		if _, err = Decompress(data, mode); err == nil {
+			t.Errorf("mode %d : bomb accepted", mode)
+		}
+
+		// Exactly the limit is fine
+		data, _ = Compress(bomb[:MaxBodyLength], mode)
+		if ret, err := Decompress(data, mode); err != nil || uint32(len(ret)) != MaxBodyLength {
+			t.Errorf("mode %d : %d bytes, error %v", mode, len(ret), err)
+		}
+	}
+
+	// Frame carrying a bomb is rejected as malformed
+	data, _ := Compress(bomb, MsgCompressDeflate)
+	msg := NewMessage(nil)
+	msg.Version = MsgVersionExtended
+	msg.Type = MsgTypeDownward
+	msg.SerializeMode = MsgSerializeRaw
+	msg.CompressMode = MsgCompressDeflate
+	frame, err := msg.Stream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace empty body with bomb
+	frame = frame[:MsgHeaderLengthExtended]
+	frame[6], frame[7], frame[8], frame[9] = byte(len(data)>>24), byte(len(data)>>16), byte(len(data)>>8), byte(len(data))
+	frame[3] = MsgCompressDeflate
+	frame = append(frame, data...)
+
+	_, _, err = parseFrame(frame)
+	if fe, ok := err.(*FrameError); !ok || fe.Kind != FrameMalformed {
+		t.Errorf("bomb frame : got error %v", err)
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -29,10 +29,10 @@
 
 package engine
 
-// Command : Input command data
+// Command : Input command data, dispatched by DefaultRouter
 /* {{{ [Command] */
-func Command(data Message) {
-	return
+func Command(msg *Message) (*Message, error) {
+	return DefaultRouter.Dispatch(msg)
 }
 
 /* }}} */
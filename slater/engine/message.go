@@ -33,8 +33,8 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-
-	"github.com/ugorji/go/codec"
+	"errors"
+	"fmt"
 )
 
 const (
@@ -87,6 +87,34 @@ const (
 	MsgStageComplete
 )
 
+const (
+	// MsgVersionLegacy : 5 bytes header
+	// Type (4 bits, never MsgTypeReserved) + SerializeMode (2 bits) + CompressMode (2 bits) + BodyLength (4 bytes)
+	MsgVersionLegacy byte = iota
+	// MsgVersionExtended : 10 bytes header
+	// Version (1 byte, high 4 bits zero) + Type (1 byte) + SerializeMode (1 byte) +
+	// CompressMode (1 byte) + Flags (2 bytes) + BodyLength (4 bytes)
+	// [+ Sequence (4 bytes) if MsgFlagSequence set]
+	MsgVersionExtended
+)
+
+const (
+	// MsgVersionCurrent : Latest header version supported
+	MsgVersionCurrent = MsgVersionExtended
+	// MsgHeaderLengthLegacy : Length of legacy header
+	MsgHeaderLengthLegacy = 5
+	// MsgHeaderLengthExtended : Length of extended header
+	MsgHeaderLengthExtended = 10
+)
+
+const (
+	// MsgFlagSequence : Sequence id (4 bytes) follows extended header
+	MsgFlagSequence uint16 = 1 << iota
+	// MsgFlagUnreliable : Message may be dropped or reordered, sent as
+	// standalone datagram on transports supporting it (UDP)
+	MsgFlagUnreliable
+)
+
 const (
 	// MsgCompressNone : No compression
 	MsgCompressNone byte = iota
@@ -107,8 +135,38 @@ const (
 	MsgSerializeMsgPack
 	// MsgSerializeAMF3 : AMF3
 	MsgSerializeAMF3
+	// MsgSerializeProtobuf : Protocol buffers
+	MsgSerializeProtobuf
+)
+
+const (
+	// FrameOversized : Body length exceeds MaxBodyLength
+	FrameOversized byte = iota + 1
+	// FrameMalformed : Header or body cannot be parsed
+	FrameMalformed
 )
 
+// MaxBodyLength : Max length of message body (bytes, both on wire and
+// decompressed), 0 for unlimited
+var MaxBodyLength uint32 = 4 * 1024 * 1024
+
+// FrameError : Error of oversized or malformed frame.
+// Stream cannot be resynchronized after it, connection should be closed
+type FrameError struct {
+	Kind byte
+	Err  error
+}
+
+// Error : Error interface
+func (e *FrameError) Error() string {
+	switch e.Kind {
+	case FrameOversized:
+		return "Oversized frame : " + e.Err.Error()
+	default:
+		return "Malformed frame : " + e.Err.Error()
+	}
+}
+
 // Body : Message body
 type Body struct {
 	App     string
@@ -118,9 +176,12 @@ type Body struct {
 
 // Message : Data struct defination
 type Message struct {
+	Version       byte
 	Type          byte
 	SerializeMode byte
 	CompressMode  byte
+	Flags         uint16
+	Sequence      uint32
 	BodyLength    uint32
 	Body          Body
 	buffer        *bytes.Buffer
@@ -135,13 +196,47 @@ func NewBody() (body *Body) {
 
 /* }}} */
 
+// Encode : Encode body into bytes
+/* {{{ [Body.Encode] Encode body */
+func (body *Body) Encode(t byte) ([]byte, error) {
+	s := GetSerializer(t)
+	if s == nil {
+		return nil, errors.New("Unsupported serialize mode")
+	}
+
+	return s.EncodeBody(body)
+}
+
+/* }}} */
+
+// BodyDecode : Decode bytes into body
+/* {{{ [BodyDecode] */
+func BodyDecode(raw []byte, t byte) (*Body, error) {
+	if raw == nil {
+		return nil, errors.New("Invalid stream")
+	}
+
+	s := GetSerializer(t)
+	if s == nil {
+		return nil, errors.New("Unsupported serialize mode")
+	}
+
+	var ret Body
+	err := s.DecodeBody(raw, &ret)
+
+	return &ret, err
+}
+
+/* }}} */
+
 // NewMessage : Create a new message
 /* {{{ [NewMessage] */
 func NewMessage(buf *bytes.Buffer) (msg *Message) {
 	return &Message{
+		Version:       MsgVersionLegacy,
 		Type:          0,
 		SerializeMode: MsgSerializeMsgPack,
-		CompressMode:  MsgCompressNone,
+		CompressMode:  DefaultCompressMode,
 		BodyLength:    0,
 		buffer:        buf,
 		Stage:         MsgStageHeader,
@@ -165,29 +260,73 @@ func (msg *Message) Parse() (bool, error) {
 		enough = true
 		switch msg.Stage {
 		case MsgStageHeader:
-			if remaining < 5 {
+			if remaining < 1 {
 				enough = false
-			} else {
-				header, _ := msg.buffer.ReadByte()
-				msg.Type = header >> 4
-				msg.SerializeMode = (header >> 2) & 3
-				msg.CompressMode = header & 3
-				var length uint32
-				var n int
-				buf := make([]byte, 4)
-				n, err = msg.buffer.Read(buf)
-				if 4 == n {
-					r := bytes.NewReader(buf)
-					binary.Read(r, binary.BigEndian, &length)
-					msg.BodyLength = length
+				break
+			}
+
+			header := msg.buffer.Bytes()
+			if 0 == header[0]>>4 {
+				// Legacy type is never MsgTypeReserved, so a first byte with
+				// high 4 bits zero is always the version of extended header
+				if remaining < MsgHeaderLengthExtended {
+					enough = false
+					break
 				}
-				if MsgTypePing == msg.Type {
-					// Force Zero
-					msg.BodyLength = 0
+
+				if header[0] == MsgVersionLegacy || header[0] > MsgVersionCurrent {
+					return false, &FrameError{
+						Kind: FrameMalformed,
+						Err:  fmt.Errorf("unsupported header version %d", header[0]),
+					}
 				}
 
-				msg.Stage++
+				flags := binary.BigEndian.Uint16(header[4:6])
+				length := MsgHeaderLengthExtended
+				if 0 != flags&MsgFlagSequence {
+					length += 4
+					if remaining < uint32(length) {
+						enough = false
+						break
+					}
+
+					msg.Sequence = binary.BigEndian.Uint32(header[10:14])
+				}
+
+				msg.Version = header[0]
+				msg.Type = header[1]
+				msg.SerializeMode = header[2]
+				msg.CompressMode = header[3]
+				msg.Flags = flags
+				msg.BodyLength = binary.BigEndian.Uint32(header[6:10])
+				msg.buffer.Next(length)
+			} else {
+				if remaining < MsgHeaderLengthLegacy {
+					enough = false
+					break
+				}
+
+				msg.Version = MsgVersionLegacy
+				msg.Type = header[0] >> 4
+				msg.SerializeMode = (header[0] >> 2) & 3
+				msg.CompressMode = header[0] & 3
+				msg.BodyLength = binary.BigEndian.Uint32(header[1:5])
+				msg.buffer.Next(MsgHeaderLengthLegacy)
 			}
+
+			if MsgTypePing == msg.Type {
+				// Force Zero
+				msg.BodyLength = 0
+			}
+
+			if MaxBodyLength > 0 && msg.BodyLength > MaxBodyLength {
+				return false, &FrameError{
+					Kind: FrameOversized,
+					Err:  fmt.Errorf("body length %d exceeds %d", msg.BodyLength, MaxBodyLength),
+				}
+			}
+
+			msg.Stage++
 			break
 		case MsgStageBody:
 			if remaining < msg.BodyLength {
@@ -196,9 +335,24 @@ func (msg *Message) Parse() (bool, error) {
 				if msg.BodyLength > 0 {
 					raw := make([]byte, msg.BodyLength)
 					msg.buffer.Read(raw)
-					var hdl codec.MsgpackHandle
-					dec := codec.NewDecoderBytes(raw, &hdl)
-					err = dec.Decode(&msg.Body)
+					raw, err = Decompress(raw, msg.CompressMode)
+					if err != nil {
+						return false, &FrameError{
+							Kind: FrameMalformed,
+							Err:  err,
+						}
+					}
+
+					var body *Body
+					body, err = BodyDecode(raw, msg.SerializeMode)
+					if err != nil {
+						return false, &FrameError{
+							Kind: FrameMalformed,
+							Err:  err,
+						}
+					}
+
+					msg.Body = *body
 				}
 
 				msg.Stage++
@@ -230,27 +384,83 @@ func (msg *Message) Stream() ([]byte, error) {
 	w := bufio.NewWriter(&buf)
 
 	// Ignore stage now
-	// Write header
-	header := ((msg.Type & 15) << 4) | ((msg.SerializeMode & 3) << 2) | (msg.CompressMode & 3)
-	buf.WriteByte(byte(header))
+	switch msg.Version {
+	case MsgVersionLegacy:
+		// Reserved type would collide with the version byte of extended header
+		if msg.Type == MsgTypeReserved || msg.Type > 15 || msg.SerializeMode > 3 || msg.CompressMode > 3 {
+			return nil, errors.New("Message cannot be carried by legacy header")
+		}
+
+		break
+	case MsgVersionExtended:
+		break
+	default:
+		return nil, fmt.Errorf("Unsupported header version %d", msg.Version)
+	}
+
+	compressMode := msg.CompressMode
+	var raw []byte
 	switch msg.Type {
-	case MsgTypeDownward:
+	case MsgTypeDownward, MsgTypeOnlineAck:
 		// Pack body
-		var raw []byte
-		var hdl codec.MsgpackHandle
-		hdl.EncodeOptions.StructToArray = true
-		enc := codec.NewEncoderBytes(&raw, &hdl)
-		err = enc.Encode(msg.Body)
+		raw, err = msg.Body.Encode(msg.SerializeMode)
+		if err != nil {
+			return nil, err
+		}
 
+		// Small body, no compression
+		if len(raw) < CompressThreshold {
+			compressMode = MsgCompressNone
+		}
+
+		raw, err = Compress(raw, compressMode)
+		if err != nil {
+			return nil, err
+		}
+
+		break
+	default:
+		// No body
+		compressMode = MsgCompressNone
+		break
+	}
+
+	// Write header
+	if MsgVersionLegacy != msg.Version {
+		flags := msg.Flags
+		if 0 != msg.Sequence {
+			flags |= MsgFlagSequence
+		}
+
+		buf.WriteByte(msg.Version)
+		buf.WriteByte(msg.Type)
+		buf.WriteByte(msg.SerializeMode)
+		buf.WriteByte(compressMode)
+		binary.Write(w, binary.BigEndian, flags)
+		binary.Write(w, binary.BigEndian, uint32(len(raw)))
+		if 0 != flags&MsgFlagSequence {
+			binary.Write(w, binary.BigEndian, msg.Sequence)
+		}
+
+		w.Flush()
+		buf.Write(raw)
+
+		return buf.Bytes(), err
+	}
+
+	header := ((msg.Type & 15) << 4) | ((msg.SerializeMode & 3) << 2) | (compressMode & 3)
+	buf.WriteByte(byte(header))
+	switch msg.Type {
+	case MsgTypeDownward, MsgTypeOnlineAck:
 		// Write length
 		binary.Write(w, binary.BigEndian, uint32(len(raw)))
 		w.Flush()
 		buf.Write(raw)
 		break
-	case MsgTypePong:
+	case MsgTypePing, MsgTypePong:
 		buf.Write([]byte{0, 0, 0, 0})
 		break
-	case MsgTypeUpwardAck:
+	case MsgTypeUpwardAck, MsgTypeOffline, MsgTypeOfflineAck:
 		buf.Write([]byte{0, 0, 0, 0})
 		break
 	default:
@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"bytes"
+	"testing"
+)
+
+// parseFrame : Parse one frame from raw bytes
+func parseFrame(raw []byte) (*Message, bool, error) {
+	msg := NewMessage(bytes.NewBuffer(raw))
+	ok, err := msg.Parse()
+
+	return msg, ok, err
+}
+
+/* {{{ [TestMessageHeader] */
+func TestMessageHeader(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     []byte
+		version byte
+		typ     byte
+		seq     uint32
+		kind    byte
+	}{
+		{
+			name:    "legacy ping",
+			raw:     []byte{MsgTypePing << 4, 0, 0, 0, 0},
+			version: MsgVersionLegacy,
+			typ:     MsgTypePing,
+		},
+		{
+			name:    "legacy offline json",
+			raw:     []byte{MsgTypeOffline<<4 | MsgSerializeJSON<<2, 0, 0, 0, 0},
+			version: MsgVersionLegacy,
+			typ:     MsgTypeOffline,
+		},
+		{
+			name:    "extended ping",
+			raw:     []byte{MsgVersionExtended, MsgTypePing, 0, 0, 0, 0, 0, 0, 0, 0},
+			version: MsgVersionExtended,
+			typ:     MsgTypePing,
+		},
+		{
+			name:    "extended sequence",
+			raw:     []byte{MsgVersionExtended, MsgTypeUpwardAck, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 7},
+			version: MsgVersionExtended,
+			typ:     MsgTypeUpwardAck,
+			seq:     7,
+		},
+		{
+			name: "version zero",
+			raw:  []byte{0, MsgTypePing, 0, 0, 0, 0, 0, 0, 0, 0},
+			kind: FrameMalformed,
+		},
+		{
+			name: "unknown version",
+			raw:  []byte{0x0F, MsgTypePing, 0, 0, 0, 0, 0, 0, 0, 0},
+			kind: FrameMalformed,
+		},
+	}
+
+	for _, c := range cases {
+		msg, ok, err := parseFrame(c.raw)
+		if c.kind != 0 {
+			fe, isFrame := err.(*FrameError)
+			if !isFrame || fe.Kind != c.kind {
+				t.Errorf("%s : got error %v, want kind %d", c.name, err, c.kind)
+			}
+
+			continue
+		}
+
+		if err != nil || !ok {
+			t.Errorf("%s : parse %v %v", c.name, ok, err)
+			continue
+		}
+
+		if msg.Version != c.version || msg.Type != c.typ || msg.Sequence != c.seq {
+			t.Errorf("%s : got version %d type %d sequence %d", c.name, msg.Version, msg.Type, msg.Sequence)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestMessageStream] */
+func TestMessageStream(t *testing.T) {
+	cases := []struct {
+		name    string
+		version byte
+		typ     byte
+		mode    byte
+		seq     uint32
+		fail    bool
+	}{
+		{"legacy downward", MsgVersionLegacy, MsgTypeDownward, MsgSerializeJSON, 0, false},
+		{"legacy reserved", MsgVersionLegacy, MsgTypeReserved, MsgSerializeJSON, 0, true},
+		{"legacy protobuf", MsgVersionLegacy, MsgTypeDownward, MsgSerializeProtobuf, 0, true},
+		{"extended downward", MsgVersionExtended, MsgTypeDownward, MsgSerializeProtobuf, 3, false},
+	}
+
+	for _, c := range cases {
+		msg := NewMessage(nil)
+		msg.Version = c.version
+		msg.Type = c.typ
+		msg.SerializeMode = c.mode
+		msg.CompressMode = MsgCompressNone
+		msg.Sequence = c.seq
+		msg.Body.App = "slater"
+		msg.Body.Payload = []byte(`{"k":"v"}`)
+
+		raw, err := msg.Stream()
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s : error expected", c.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s : %s", c.name, err)
+			continue
+		}
+
+		ret, ok, err := parseFrame(raw)
+		if err != nil || !ok {
+			t.Errorf("%s : parse %v %v", c.name, ok, err)
+			continue
+		}
+
+		if ret.Version != c.version || ret.Type != c.typ || ret.Sequence != c.seq ||
+			!bytes.Equal(ret.Body.Payload, msg.Body.Payload) {
+			t.Errorf("%s : got %+v", c.name, ret)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestFrameError] */
+func TestFrameError(t *testing.T) {
+	defer func(n uint32) { MaxBodyLength = n }(MaxBodyLength)
+	MaxBodyLength = 1024
+
+	cases := []struct {
+		name string
+		raw  []byte
+		kind byte
+	}{
+		{
+			name: "legacy oversized",
+			raw:  []byte{MsgTypeDownward << 4, 0, 0, 0x04, 0x01},
+			kind: FrameOversized,
+		},
+		{
+			name: "extended oversized",
+			raw:  []byte{MsgVersionExtended, MsgTypeDownward, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF},
+			kind: FrameOversized,
+		},
+		{
+			name: "bad deflate",
+			raw:  []byte{MsgTypeDownward<<4 | MsgCompressDeflate, 0, 0, 0, 2, 0xFF, 0xFF},
+			kind: FrameMalformed,
+		},
+		{
+			name: "bad json",
+			raw:  []byte{MsgTypeDownward<<4 | MsgSerializeJSON<<2, 0, 0, 0, 2, '{', '['},
+			kind: FrameMalformed,
+		},
+		{
+			name: "bad compress mode",
+			raw:  []byte{MsgVersionExtended, MsgTypeDownward, 0, 9, 0, 0, 0, 0, 0, 1, 0},
+			kind: FrameMalformed,
+		},
+		{
+			name: "ping ignores length",
+			raw:  []byte{MsgTypePing << 4, 0xFF, 0xFF, 0xFF, 0xFF},
+		},
+		{
+			name: "limit",
+			raw:  append([]byte{MsgTypeDownward << 4, 0, 0, 0x04, 0x00}, make([]byte, 1024)...),
+		},
+	}
+
+	for _, c := range cases {
+		_, ok, err := parseFrame(c.raw)
+		if c.kind == 0 {
+			if err != nil || !ok {
+				t.Errorf("%s : parse %v %v", c.name, ok, err)
+			}
+
+			continue
+		}
+
+		fe, isFrame := err.(*FrameError)
+		if !isFrame || fe.Kind != c.kind {
+			t.Errorf("%s : got error %v, want kind %d", c.name, err, c.kind)
+		}
+	}
+
+	// Incomplete frame is not an error
+	if _, ok, err := parseFrame([]byte{MsgTypeDownward << 4, 0, 0, 0, 8, 1}); ok || err != nil {
+		t.Errorf("incomplete : parse %v %v", ok, err)
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,578 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Protocol buffers wire types
+const (
+	pbWireVarint  = 0
+	pbWireFixed64 = 1
+	pbWireBytes   = 2
+	pbWireFixed32 = 5
+)
+
+// pbMaxDepth : Max nesting level of Value
+const pbMaxDepth = 64
+
+// pbBuffer : Protocol buffers wire encoder
+type pbBuffer struct {
+	buf []byte
+}
+
+// pbReader : Protocol buffers wire decoder
+type pbReader struct {
+	buf []byte
+	pos int
+}
+
+/* {{{ [pbBuffer] */
+func (b *pbBuffer) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	b.buf = append(b.buf, tmp[:n]...)
+}
+
+func (b *pbBuffer) tag(field int, wire int) {
+	b.varint(uint64(field<<3 | wire))
+}
+
+func (b *pbBuffer) bytes(field int, data []byte) {
+	b.tag(field, pbWireBytes)
+	b.varint(uint64(len(data)))
+	b.buf = append(b.buf, data...)
+}
+
+func (b *pbBuffer) string(field int, s string) {
+	b.tag(field, pbWireBytes)
+	b.varint(uint64(len(s)))
+	b.buf = append(b.buf, s...)
+}
+
+func (b *pbBuffer) double(field int, f float64) {
+	var tmp [8]byte
+	b.tag(field, pbWireFixed64)
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(f))
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+/* }}} */
+
+/* {{{ [pbReader] */
+func (r *pbReader) eof() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *pbReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errors.New("Protobuf : invalid varint")
+	}
+
+	r.pos += n
+
+	return v, nil
+}
+
+func (r *pbReader) next() (int, int, error) {
+	v, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(v >> 3), int(v & 7), nil
+}
+
+func (r *pbReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+
+	if n > uint64(len(r.buf)-r.pos) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	ret := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+
+	return ret, nil
+}
+
+func (r *pbReader) fixed64() (uint64, error) {
+	if len(r.buf)-r.pos < 8 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	v := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+
+	return v, nil
+}
+
+func (r *pbReader) skip(wire int) error {
+	var err error
+	switch wire {
+	case pbWireVarint:
+		_, err = r.varint()
+	case pbWireFixed64:
+		_, err = r.fixed64()
+	case pbWireBytes:
+		_, err = r.bytes()
+	case pbWireFixed32:
+		if len(r.buf)-r.pos < 4 {
+			return io.ErrUnexpectedEOF
+		}
+
+		r.pos += 4
+	default:
+		err = fmt.Errorf("Protobuf : unsupported wire type %d", wire)
+	}
+
+	return err
+}
+
+/* }}} */
+
+// pbEncodeValue : Encode go value as slater.Value
+/* {{{ [pbEncodeValue] */
+func pbEncodeValue(v reflect.Value, depth int) ([]byte, error) {
+	if depth > pbMaxDepth {
+		return nil, errors.New("Protobuf : value nested too deep")
+	}
+
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	var b pbBuffer
+	if !v.IsValid() || ((v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && v.IsNil()) {
+		b.tag(1, pbWireVarint)
+		b.varint(1)
+		return b.buf, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b.tag(2, pbWireVarint)
+		if v.Bool() {
+			b.varint(1)
+		} else {
+			b.varint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := v.Int()
+		b.tag(3, pbWireVarint)
+		b.varint(uint64(i<<1) ^ uint64(i>>63))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			b.double(4, float64(u))
+		} else {
+			i := int64(u)
+			b.tag(3, pbWireVarint)
+			b.varint(uint64(i<<1) ^ uint64(i>>63))
+		}
+	case reflect.Float32, reflect.Float64:
+		b.double(4, v.Float())
+	case reflect.String:
+		b.string(5, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			b.bytes(6, data)
+			break
+		}
+
+		var list pbBuffer
+		for i := 0; i < v.Len(); i++ {
+			item, err := pbEncodeValue(v.Index(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			list.bytes(1, item)
+		}
+
+		b.bytes(7, list.buf)
+	case reflect.Map:
+		var fields pbBuffer
+		for _, key := range v.MapKeys() {
+			item, err := pbEncodeValue(v.MapIndex(key), depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			var entry pbBuffer
+			entry.string(1, fmt.Sprint(key.Interface()))
+			entry.bytes(2, item)
+			fields.bytes(1, entry.buf)
+		}
+
+		b.bytes(8, fields.buf)
+	default:
+		return nil, fmt.Errorf("Protobuf : unsupported type %s", v.Type())
+	}
+
+	return b.buf, nil
+}
+
+/* }}} */
+
+// pbDecodeValue : Decode slater.Value into go value
+/* {{{ [pbDecodeValue] */
+func pbDecodeValue(raw []byte, depth int) (interface{}, error) {
+	if depth > pbMaxDepth {
+		return nil, errors.New("Protobuf : value nested too deep")
+	}
+
+	var ret interface{}
+	r := &pbReader{buf: raw}
+	for !r.eof() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case field == 1 && wire == pbWireVarint:
+			_, err = r.varint()
+			ret = nil
+		case field == 2 && wire == pbWireVarint:
+			var u uint64
+			u, err = r.varint()
+			ret = u != 0
+		case field == 3 && wire == pbWireVarint:
+			var u uint64
+			u, err = r.varint()
+			ret = int64(u>>1) ^ -int64(u&1)
+		case field == 4 && wire == pbWireFixed64:
+			var u uint64
+			u, err = r.fixed64()
+			ret = math.Float64frombits(u)
+		case field == 5 && wire == pbWireBytes:
+			var data []byte
+			data, err = r.bytes()
+			ret = string(data)
+		case field == 6 && wire == pbWireBytes:
+			var data []byte
+			data, err = r.bytes()
+			ret = append([]byte{}, data...)
+		case field == 7 && wire == pbWireBytes:
+			var data []byte
+			data, err = r.bytes()
+			if err == nil {
+				ret, err = pbDecodeList(data, depth)
+			}
+		case field == 8 && wire == pbWireBytes:
+			var data []byte
+			data, err = r.bytes()
+			if err == nil {
+				ret, err = pbDecodeMap(data, depth)
+			}
+		default:
+			err = r.skip(wire)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func pbDecodeList(raw []byte, depth int) ([]interface{}, error) {
+	ret := make([]interface{}, 0)
+	r := &pbReader{buf: raw}
+	for !r.eof() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if field == 1 && wire == pbWireBytes {
+			data, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+
+			item, err := pbDecodeValue(data, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, item)
+		} else if err = r.skip(wire); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func pbDecodeMap(raw []byte, depth int) (map[string]interface{}, error) {
+	ret := make(map[string]interface{})
+	r := &pbReader{buf: raw}
+	for !r.eof() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if field == 1 && wire == pbWireBytes {
+			data, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+
+			key, value, err := pbDecodeEntry(data)
+			if err != nil {
+				return nil, err
+			}
+
+			ret[key], err = pbDecodeValue(value, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		} else if err = r.skip(wire); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// pbDecodeEntry : Decode map entry, returns key and raw value
+func pbDecodeEntry(raw []byte) (string, []byte, error) {
+	var (
+		key   string
+		value []byte
+	)
+
+	r := &pbReader{buf: raw}
+	for !r.eof() {
+		field, wire, err := r.next()
+		if err != nil {
+			return "", nil, err
+		}
+
+		if (field == 1 || field == 2) && wire == pbWireBytes {
+			data, err := r.bytes()
+			if err != nil {
+				return "", nil, err
+			}
+
+			if field == 1 {
+				key = string(data)
+			} else {
+				value = data
+			}
+		} else if err = r.skip(wire); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return key, value, nil
+}
+
+/* }}} */
+
+// protobufSerializer : Protocol buffers, schema in slater.proto
+/* {{{ [protobufSerializer] */
+type protobufSerializer struct{}
+
+func (s *protobufSerializer) EncodeCommand(cmd *CommonCommand) ([]byte, error) {
+	var b pbBuffer
+	if cmd.Command != 0 {
+		b.tag(1, pbWireVarint)
+		b.varint(uint64(int64(cmd.Command)))
+	}
+
+	for key, value := range cmd.Params {
+		item, err := pbEncodeValue(reflect.ValueOf(value), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry pbBuffer
+		entry.string(1, key)
+		entry.bytes(2, item)
+		b.bytes(2, entry.buf)
+	}
+
+	for key, value := range cmd.Additional {
+		var entry pbBuffer
+		entry.string(1, key)
+		entry.string(2, value)
+		b.bytes(3, entry.buf)
+	}
+
+	return b.buf, nil
+}
+
+func (s *protobufSerializer) DecodeCommand(raw []byte, cmd *CommonCommand) error {
+	r := &pbReader{buf: raw}
+	for !r.eof() {
+		field, wire, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wire == pbWireVarint:
+			var u uint64
+			u, err = r.varint()
+			cmd.Command = int(int64(u))
+		case (field == 2 || field == 3) && wire == pbWireBytes:
+			var (
+				data  []byte
+				key   string
+				value []byte
+			)
+
+			data, err = r.bytes()
+			if err == nil {
+				key, value, err = pbDecodeEntry(data)
+			}
+
+			if err != nil {
+				break
+			}
+
+			if field == 2 {
+				if cmd.Params == nil {
+					cmd.Params = make(map[string]interface{})
+				}
+
+				cmd.Params[key], err = pbDecodeValue(value, 0)
+			} else {
+				if cmd.Additional == nil {
+					cmd.Additional = make(map[string]string)
+				}
+
+				cmd.Additional[key] = string(value)
+			}
+		default:
+			err = r.skip(wire)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *protobufSerializer) EncodeBody(body *Body) ([]byte, error) {
+	var b pbBuffer
+	if body.App != "" {
+		b.string(1, body.App)
+	}
+
+	if len(body.UID) > 0 {
+		// Packed
+		var uids pbBuffer
+		for _, uid := range body.UID {
+			uids.varint(uint64(uid))
+		}
+
+		b.bytes(2, uids.buf)
+	}
+
+	if len(body.Payload) > 0 {
+		b.bytes(3, body.Payload)
+	}
+
+	return b.buf, nil
+}
+
+func (s *protobufSerializer) DecodeBody(raw []byte, body *Body) error {
+	r := &pbReader{buf: raw}
+	for !r.eof() {
+		field, wire, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wire == pbWireBytes:
+			var data []byte
+			data, err = r.bytes()
+			body.App = string(data)
+		case field == 2 && wire == pbWireVarint:
+			// Unpacked
+			var u uint64
+			u, err = r.varint()
+			body.UID = append(body.UID, int64(u))
+		case field == 2 && wire == pbWireBytes:
+			var data []byte
+			data, err = r.bytes()
+			uids := &pbReader{buf: data}
+			for err == nil && !uids.eof() {
+				var u uint64
+				u, err = uids.varint()
+				body.UID = append(body.UID, int64(u))
+			}
+		case field == 3 && wire == pbWireBytes:
+			var data []byte
+			data, err = r.bytes()
+			body.Payload = append([]byte{}, data...)
+		default:
+			err = r.skip(wire)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
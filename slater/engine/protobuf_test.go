@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+/* {{{ [TestProtobufBody] */
+func TestProtobufBody(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+		body Body
+		fail bool
+	}{
+		{
+			name: "packed uid",
+			raw:  []byte{0x0A, 0x01, 'a', 0x12, 0x02, 0x01, 0x02, 0x1A, 0x01, 'p'},
+			body: Body{App: "a", UID: []int64{1, 2}, Payload: []byte("p")},
+		},
+		{
+			name: "unpacked uid",
+			raw:  []byte{0x10, 0x01, 0x10, 0x96, 0x01},
+			body: Body{UID: []int64{1, 150}},
+		},
+		{
+			name: "unknown fields",
+			raw: []byte{
+				0x78, 0x05, // 15 varint
+				0x82, 0x01, 0x02, 'x', 'y', // 16 bytes
+				0x8D, 0x01, 0x01, 0x02, 0x03, 0x04, // 17 fixed32
+				0x91, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // 18 fixed64
+				0x0A, 0x01, 'a',
+			},
+			body: Body{App: "a"},
+		},
+		{name: "truncated tag", raw: []byte{0x80}, fail: true},
+		{name: "truncated varint", raw: []byte{0x10, 0x80}, fail: true},
+		{name: "truncated packed", raw: []byte{0x12, 0x01, 0x80}, fail: true},
+		{name: "truncated bytes", raw: []byte{0x1A, 0x05, 'p'}, fail: true},
+		{name: "truncated fixed64", raw: []byte{0x91, 0x01, 0x01}, fail: true},
+		{name: "group wire type", raw: []byte{0x0B}, fail: true},
+	}
+
+	s := &protobufSerializer{}
+	for _, c := range cases {
+		var body Body
+		err := s.DecodeBody(c.raw, &body)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s : error expected", c.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s : %s", c.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(body, c.body) {
+			t.Errorf("%s : got %+v, want %+v", c.name, body, c.body)
+		}
+	}
+
+	// Round trip, negative uid takes ten bytes varint
+	body := Body{App: "slater", UID: []int64{-1, 0, 1 << 40}, Payload: []byte{0, 1, 2}}
+	raw, err := s.EncodeBody(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ret Body
+	if err = s.DecodeBody(raw, &ret); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ret, body) {
+		t.Errorf("round trip : got %+v, want %+v", ret, body)
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestProtobufCommand] */
+func TestProtobufCommand(t *testing.T) {
+	cmd := &CommonCommand{
+		Command: -5,
+		Params: map[string]interface{}{
+			"null":   nil,
+			"bool":   true,
+			"int":    -42,
+			"double": 2.5,
+			"string": "s",
+			"bytes":  []byte{1, 2},
+			"list":   []interface{}{int64(1), "a"},
+			"map":    map[string]interface{}{"k": false},
+		},
+		Additional: map[string]string{"app": "slater"},
+	}
+
+	want := &CommonCommand{
+		Command: -5,
+		Params: map[string]interface{}{
+			"null":   nil,
+			"bool":   true,
+			"int":    int64(-42),
+			"double": 2.5,
+			"string": "s",
+			"bytes":  []byte{1, 2},
+			"list":   []interface{}{int64(1), "a"},
+			"map":    map[string]interface{}{"k": false},
+		},
+		Additional: map[string]string{"app": "slater"},
+	}
+
+	s := &protobufSerializer{}
+	raw, err := s.EncodeCommand(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown field appended
+	raw = append(raw, 0x20, 0x01)
+
+	var ret CommonCommand
+	if err = s.DecodeCommand(raw, &ret); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&ret, want) {
+		t.Errorf("got %+v, want %+v", ret, want)
+	}
+
+	if err = s.DecodeCommand(raw[:len(raw)-3], &ret); err == nil {
+		t.Error("truncated command : error expected")
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestProtobufDepth] */
+func TestProtobufDepth(t *testing.T) {
+	var v interface{} = "leaf"
+	for i := 0; i < pbMaxDepth+1; i++ {
+		v = []interface{}{v}
+	}
+
+	cmd := &CommonCommand{Params: map[string]interface{}{"v": v}}
+	if _, err := cmd.Encode(MsgSerializeProtobuf); err == nil {
+		t.Error("encode : nesting limit not enforced")
+	}
+
+	// Value { list_value = ListValue { values = [...] } } nested by hand
+	var leaf pbBuffer
+	leaf.string(5, "leaf")
+	raw := leaf.buf
+	for i := 0; i < pbMaxDepth+1; i++ {
+		var list, value pbBuffer
+		list.bytes(1, raw)
+		value.bytes(7, list.buf)
+		raw = value.buf
+	}
+
+	if _, err := pbDecodeValue(raw, 0); err == nil {
+		t.Error("decode : nesting limit not enforced")
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// CmdError : Command id of standard error response
+const CmdError = -1
+
+const (
+	// CmdErrorUnknownCommand : No handler registered for command id
+	CmdErrorUnknownCommand = iota + 1
+	// CmdErrorInvalidCommand : Payload or params cannot be decoded
+	CmdErrorInvalidCommand
+	// CmdErrorHandler : Handler returned error
+	CmdErrorHandler
+)
+
+// CommandHandler : Handler of command, returned command (if not nil) will be
+// sent back to client in a downward message
+type CommandHandler func(msg *Message, cmd *CommonCommand) (*CommonCommand, error)
+
+// Router : Route CommonCommand to handlers by command id
+type Router struct {
+	handlers map[int]CommandHandler
+	lock     sync.RWMutex
+}
+
+// DefaultRouter : Router used by Command
+var DefaultRouter = NewRouter()
+
+// NewRouter : Create a new router
+/* {{{ [NewRouter] */
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[int]CommandHandler),
+	}
+}
+
+/* }}} */
+
+// Handle : Register handler of command id, former one will be replaced
+/* {{{ [Router.Handle] */
+func (r *Router) Handle(id int, handler CommandHandler) error {
+	if handler == nil {
+		return errors.New("Invalid command handler")
+	}
+
+	r.lock.Lock()
+	r.handlers[id] = handler
+	r.lock.Unlock()
+
+	return nil
+}
+
+/* }}} */
+
+// HandleFunc : Register typed handler of command id.
+// fn must be func(*Message, *T) (*CommonCommand, error), params of
+// command will be bound into a new T before calling
+/* {{{ [Router.HandleFunc] */
+func (r *Router) HandleFunc(id int, fn interface{}) error {
+	fv := reflect.ValueOf(fn)
+	if !fv.IsValid() {
+		return errors.New("Invalid command handler")
+	}
+
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 2 ||
+		ft.In(0) != reflect.TypeOf(&Message{}) || ft.In(1).Kind() != reflect.Ptr ||
+		ft.Out(0) != reflect.TypeOf(&CommonCommand{}) ||
+		ft.Out(1) != reflect.TypeOf((*error)(nil)).Elem() {
+		return errors.New("Handler must be func(*Message, *T) (*CommonCommand, error)")
+	}
+
+	pt := ft.In(1).Elem()
+
+	return r.Handle(id, func(msg *Message, cmd *CommonCommand) (*CommonCommand, error) {
+		params := reflect.New(pt)
+		err := cmd.Bind(params.Interface())
+		if err != nil {
+			return NewErrorCommand(cmd.Command, CmdErrorInvalidCommand, err.Error()), nil
+		}
+
+		out := fv.Call([]reflect.Value{reflect.ValueOf(msg), params})
+		ret, _ := out[0].Interface().(*CommonCommand)
+		err, _ = out[1].Interface().(error)
+
+		return ret, err
+	})
+}
+
+/* }}} */
+
+// Dispatch : Decode command from message payload and call its handler.
+// Returns downward message of response, nil if no response
+/* {{{ [Router.Dispatch] */
+func (r *Router) Dispatch(msg *Message) (*Message, error) {
+	if msg == nil {
+		return nil, errors.New("Invalid message object")
+	}
+
+	var resp *CommonCommand
+	cmd, err := CmdDecode(msg.Body.Payload, msg.SerializeMode)
+	if err != nil {
+		resp = NewErrorCommand(0, CmdErrorInvalidCommand, err.Error())
+	} else {
+		r.lock.RLock()
+		handler, ok := r.handlers[cmd.Command]
+		r.lock.RUnlock()
+
+		if !ok {
+			resp = NewErrorCommand(cmd.Command, CmdErrorUnknownCommand, fmt.Sprintf("Unknown command %d", cmd.Command))
+		} else {
+			resp, err = handler(msg, cmd)
+			if err != nil {
+				resp = NewErrorCommand(cmd.Command, CmdErrorHandler, err.Error())
+			}
+		}
+	}
+
+	if resp == nil {
+		return nil, nil
+	}
+
+	ret := NewMessage(nil)
+	ret.Type = MsgTypeDownward
+	ret.SerializeMode = msg.SerializeMode
+	ret.Body.App = msg.Body.App
+	ret.Body.UID = msg.Body.UID
+	ret.Body.Payload, err = resp.Encode(msg.SerializeMode)
+
+	return ret, err
+}
+
+/* }}} */
+
+// RegisterCommand : Register handler of command id into DefaultRouter
+/* {{{ [RegisterCommand] */
+func RegisterCommand(id int, handler CommandHandler) error {
+	return DefaultRouter.Handle(id, handler)
+}
+
+/* }}} */
+
+// RegisterCommandFunc : Register typed handler of command id into DefaultRouter
+/* {{{ [RegisterCommandFunc] */
+func RegisterCommandFunc(id int, fn interface{}) error {
+	return DefaultRouter.HandleFunc(id, fn)
+}
+
+/* }}} */
+
+// NewErrorCommand : Standard error response of command
+/* {{{ [NewErrorCommand] */
+func NewErrorCommand(id int, code int, message string) *CommonCommand {
+	return &CommonCommand{
+		Command: CmdError,
+		Params: map[string]interface{}{
+			"command": id,
+			"code":    code,
+			"message": message,
+		},
+	}
+}
+
+/* }}} */
+
+// Bind : Bind params of command into struct (or map) pointed by v,
+// fields matched by name or `codec` tag
+/* {{{ [Bind] */
+func (cmd *CommonCommand) Bind(v interface{}) error {
+	var (
+		raw []byte
+		hdl codec.MsgpackHandle
+	)
+
+	hdl.RawToString = true
+	enc := codec.NewEncoderBytes(&raw, &hdl)
+	err := enc.Encode(cmd.Params)
+	if err != nil {
+		return err
+	}
+
+	dec := codec.NewDecoderBytes(raw, &hdl)
+
+	return dec.Decode(v)
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+// commandMessage : Upward message carrying JSON encoded command
+func commandMessage(t *testing.T, cmd *CommonCommand) *Message {
+	msg := NewMessage(nil)
+	msg.Type = MsgTypeUpward
+	msg.SerializeMode = MsgSerializeJSON
+	msg.Body.App = "test"
+	if cmd != nil {
+		raw, err := cmd.Encode(MsgSerializeJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg.Body.Payload = raw
+	}
+
+	return msg
+}
+
+// errorResponse : Params of standard error response
+type errorResponse struct {
+	Command int    `codec:"command"`
+	Code    int    `codec:"code"`
+	Message string `codec:"message"`
+}
+
+// dispatch : Dispatch message by router, response command decoded
+func dispatch(t *testing.T, r *Router, msg *Message) *CommonCommand {
+	resp, err := r.Dispatch(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	if resp.Type != MsgTypeDownward || resp.Body.App != msg.Body.App {
+		t.Errorf("response type %d, app %q", resp.Type, resp.Body.App)
+	}
+
+	cmd, err := CmdDecode(resp.Body.Payload, resp.SerializeMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cmd
+}
+
+/* {{{ [TestRouterDispatch] */
+func TestRouterDispatch(t *testing.T) {
+	r := NewRouter()
+	r.Handle(1, func(msg *Message, cmd *CommonCommand) (*CommonCommand, error) {
+		return &CommonCommand{Command: cmd.Command + 1000}, nil
+	})
+	r.Handle(2, func(msg *Message, cmd *CommonCommand) (*CommonCommand, error) {
+		return nil, errors.New("failed")
+	})
+	r.Handle(3, func(msg *Message, cmd *CommonCommand) (*CommonCommand, error) {
+		return nil, nil
+	})
+
+	if resp := dispatch(t, r, commandMessage(t, &CommonCommand{Command: 1})); resp == nil || resp.Command != 1001 {
+		t.Errorf("known command : got %+v", resp)
+	}
+
+	if resp := dispatch(t, r, commandMessage(t, &CommonCommand{Command: 3})); resp != nil {
+		t.Errorf("no response : got %+v", resp)
+	}
+
+	invalid := commandMessage(t, nil)
+	invalid.Body.Payload = []byte("not a command")
+	cases := []struct {
+		name    string
+		msg     *Message
+		command int
+		code    int
+	}{
+		{"unknown command", commandMessage(t, &CommonCommand{Command: 9}), 9, CmdErrorUnknownCommand},
+		{"handler error", commandMessage(t, &CommonCommand{Command: 2}), 2, CmdErrorHandler},
+		{"invalid payload", invalid, 0, CmdErrorInvalidCommand},
+	}
+
+	for _, c := range cases {
+		resp := dispatch(t, r, c.msg)
+		if resp == nil || resp.Command != CmdError {
+			t.Errorf("%s : got %+v, want error response", c.name, resp)
+			continue
+		}
+
+		var e errorResponse
+		if err := resp.Bind(&e); err != nil {
+			t.Fatalf("%s : bind : %s", c.name, err)
+		}
+
+		if e.Command != c.command || e.Code != c.code || e.Message == "" {
+			t.Errorf("%s : got %+v", c.name, e)
+		}
+	}
+
+	if _, err := r.Dispatch(nil); err == nil {
+		t.Error("nil message dispatched")
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestRouterHandleFunc] */
+func TestRouterHandleFunc(t *testing.T) {
+	type login struct {
+		Name  string `codec:"name"`
+		Level int    `codec:"level"`
+	}
+
+	r := NewRouter()
+	var got *login
+	err := r.HandleFunc(1, func(msg *Message, params *login) (*CommonCommand, error) {
+		got = params
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch(t, r, commandMessage(t, &CommonCommand{
+		Command: 1,
+		Params:  map[string]interface{}{"name": "slater", "level": 3},
+	}))
+	if got == nil || got.Name != "slater" || got.Level != 3 {
+		t.Errorf("bound params %+v", got)
+	}
+
+	// Params not matching type
+	resp := dispatch(t, r, commandMessage(t, &CommonCommand{
+		Command: 1,
+		Params:  map[string]interface{}{"level": "high"},
+	}))
+	var e errorResponse
+	if resp == nil || resp.Command != CmdError || resp.Bind(&e) != nil || e.Code != CmdErrorInvalidCommand {
+		t.Errorf("mismatched params : got %+v", resp)
+	}
+
+	bad := []struct {
+		name string
+		fn   interface{}
+	}{
+		{"nil", nil},
+		{"not func", 1},
+		{"no params", func(msg *Message) (*CommonCommand, error) { return nil, nil }},
+		{"params not pointer", func(msg *Message, params login) (*CommonCommand, error) { return nil, nil }},
+		{"message not pointer", func(msg Message, params *login) (*CommonCommand, error) { return nil, nil }},
+		{"no error", func(msg *Message, params *login) *CommonCommand { return nil }},
+		{"wrong result", func(msg *Message, params *login) (*Message, error) { return nil, nil }},
+	}
+
+	for _, c := range bad {
+		if err := r.HandleFunc(2, c.fn); err == nil {
+			t.Errorf("%s : handler accepted", c.name)
+		}
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
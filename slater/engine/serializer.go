@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Serializer : Codec of CommonCommand and message Body,
+// selected by the serialize mode of message header
+type Serializer interface {
+	// EncodeCommand : Encode command into bytes
+	EncodeCommand(cmd *CommonCommand) ([]byte, error)
+
+	// DecodeCommand : Decode bytes into command
+	DecodeCommand(raw []byte, cmd *CommonCommand) error
+
+	// EncodeBody : Encode message body into bytes
+	EncodeBody(body *Body) ([]byte, error)
+
+	// DecodeBody : Decode bytes into message body
+	DecodeBody(raw []byte, body *Body) error
+}
+
+// ErrRawCommand : Raw serialize mode carries no command
+var ErrRawCommand = errors.New("Command is not supported in raw serialize mode")
+
+// Serializer registry
+var (
+	serializers     = make(map[byte]Serializer)
+	serializersLock sync.RWMutex
+)
+
+// RegisterSerializer : Register serializer of serialize mode,
+// former one of the same mode will be replaced
+/* {{{ [RegisterSerializer] */
+func RegisterSerializer(t byte, s Serializer) error {
+	if s == nil {
+		return errors.New("Invalid serializer")
+	}
+
+	serializersLock.Lock()
+	serializers[t] = s
+	serializersLock.Unlock()
+
+	return nil
+}
+
+/* }}} */
+
+// GetSerializer : Get serializer of serialize mode, nil if not registered
+/* {{{ [GetSerializer] */
+func GetSerializer(t byte) Serializer {
+	serializersLock.RLock()
+	s := serializers[t]
+	serializersLock.RUnlock()
+
+	return s
+}
+
+/* }}} */
+
+// rawSerializer : No serialization, body is payload itself
+/* {{{ [rawSerializer] */
+type rawSerializer struct{}
+
+func (s *rawSerializer) EncodeCommand(cmd *CommonCommand) ([]byte, error) {
+	return nil, ErrRawCommand
+}
+
+func (s *rawSerializer) DecodeCommand(raw []byte, cmd *CommonCommand) error {
+	return ErrRawCommand
+}
+
+func (s *rawSerializer) EncodeBody(body *Body) ([]byte, error) {
+	return body.Payload, nil
+}
+
+func (s *rawSerializer) DecodeBody(raw []byte, body *Body) error {
+	body.Payload = raw
+
+	return nil
+}
+
+/* }}} */
+
+// jsonSerializer : JSON, payload of body embedded as JSON document
+/* {{{ [jsonSerializer] */
+type jsonSerializer struct{}
+
+type jsonBody struct {
+	App     string
+	UID     []int64
+	Payload json.RawMessage
+}
+
+func (s *jsonSerializer) EncodeCommand(cmd *CommonCommand) ([]byte, error) {
+	var ret []byte
+	var hdl codec.JsonHandle
+	enc := codec.NewEncoderBytes(&ret, &hdl)
+	err := enc.Encode(cmd)
+
+	return ret, err
+}
+
+func (s *jsonSerializer) DecodeCommand(raw []byte, cmd *CommonCommand) error {
+	var hdl codec.JsonHandle
+	dec := codec.NewDecoderBytes(raw, &hdl)
+
+	return dec.Decode(cmd)
+}
+
+func (s *jsonSerializer) EncodeBody(body *Body) ([]byte, error) {
+	jb := jsonBody{
+		App: body.App,
+		UID: body.UID,
+	}
+	if len(body.Payload) > 0 {
+		if !json.Valid(body.Payload) {
+			return nil, errors.New("Payload is not a valid JSON document")
+		}
+
+		jb.Payload = body.Payload
+	}
+
+	return json.Marshal(&jb)
+}
+
+func (s *jsonSerializer) DecodeBody(raw []byte, body *Body) error {
+	var jb jsonBody
+	err := json.Unmarshal(raw, &jb)
+	body.App = jb.App
+	body.UID = jb.UID
+	if len(jb.Payload) > 0 && "null" != string(jb.Payload) {
+		body.Payload = []byte(jb.Payload)
+	}
+
+	return err
+}
+
+/* }}} */
+
+// msgpackSerializer : MessagePack
+/* {{{ [msgpackSerializer] */
+type msgpackSerializer struct{}
+
+func (s *msgpackSerializer) encode(v interface{}) ([]byte, error) {
+	var ret []byte
+	var hdl codec.MsgpackHandle
+	hdl.EncodeOptions.StructToArray = true
+	enc := codec.NewEncoderBytes(&ret, &hdl)
+	err := enc.Encode(v)
+
+	return ret, err
+}
+
+func (s *msgpackSerializer) decode(raw []byte, v interface{}) error {
+	var hdl codec.MsgpackHandle
+	dec := codec.NewDecoderBytes(raw, &hdl)
+
+	return dec.Decode(v)
+}
+
+func (s *msgpackSerializer) EncodeCommand(cmd *CommonCommand) ([]byte, error) {
+	return s.encode(cmd)
+}
+
+func (s *msgpackSerializer) DecodeCommand(raw []byte, cmd *CommonCommand) error {
+	return s.decode(raw, cmd)
+}
+
+func (s *msgpackSerializer) EncodeBody(body *Body) ([]byte, error) {
+	return s.encode(body)
+}
+
+func (s *msgpackSerializer) DecodeBody(raw []byte, body *Body) error {
+	return s.decode(raw, body)
+}
+
+/* }}} */
+
+// amf3Serializer : AMF3
+/* {{{ [amf3Serializer] */
+type amf3Serializer struct{}
+
+func (s *amf3Serializer) EncodeCommand(cmd *CommonCommand) ([]byte, error) {
+	return AMF3Marshal(cmd)
+}
+
+func (s *amf3Serializer) DecodeCommand(raw []byte, cmd *CommonCommand) error {
+	return AMF3DecodeCommand(raw, cmd)
+}
+
+func (s *amf3Serializer) EncodeBody(body *Body) ([]byte, error) {
+	return AMF3Marshal(body)
+}
+
+func (s *amf3Serializer) DecodeBody(raw []byte, body *Body) error {
+	return AMF3DecodeBody(raw, body)
+}
+
+/* }}} */
+
+// init : Register builtin serializers
+/* {{{ [init] */
+func init() {
+	RegisterSerializer(MsgSerializeRaw, &rawSerializer{})
+	RegisterSerializer(MsgSerializeJSON, &jsonSerializer{})
+	RegisterSerializer(MsgSerializeMsgPack, &msgpackSerializer{})
+	RegisterSerializer(MsgSerializeAMF3, &amf3Serializer{})
+	RegisterSerializer(MsgSerializeProtobuf, &protobufSerializer{})
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
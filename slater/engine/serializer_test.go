@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package engine
+
+import (
+	"bytes"
+	"testing"
+)
+
+/* {{{ [TestSerializerCommand] */
+func TestSerializerCommand(t *testing.T) {
+	cmd := &CommonCommand{
+		Command:    1001,
+		Additional: map[string]string{"app": "slater"},
+	}
+
+	cases := []struct {
+		name string
+		mode byte
+		err  error
+	}{
+		{"raw", MsgSerializeRaw, ErrRawCommand},
+		{"json", MsgSerializeJSON, nil},
+		{"msgpack", MsgSerializeMsgPack, nil},
+		{"amf3", MsgSerializeAMF3, nil},
+		{"protobuf", MsgSerializeProtobuf, nil},
+	}
+
+	for _, c := range cases {
+		raw, err := cmd.Encode(c.mode)
+		if err != c.err {
+			t.Errorf("%s : encode error %v, want %v", c.name, err, c.err)
+			continue
+		}
+
+		if c.err != nil {
+			if _, err = CmdDecode([]byte{}, c.mode); err != c.err {
+				t.Errorf("%s : decode error %v, want %v", c.name, err, c.err)
+			}
+
+			continue
+		}
+
+		ret, err := CmdDecode(raw, c.mode)
+		if err != nil {
+			t.Fatalf("%s : decode : %s", c.name, err)
+		}
+
+		if ret.Command != cmd.Command || ret.Additional["app"] != "slater" {
+			t.Errorf("%s : got %+v", c.name, ret)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestSerializerBody] */
+func TestSerializerBody(t *testing.T) {
+	modes := []byte{
+		MsgSerializeRaw,
+		MsgSerializeJSON,
+		MsgSerializeMsgPack,
+		MsgSerializeAMF3,
+		MsgSerializeProtobuf,
+	}
+
+	for _, mode := range modes {
+		body := &Body{
+			App:     "slater",
+			UID:     []int64{1, 2},
+			Payload: []byte(`{"k":"v"}`),
+		}
+
+		raw, err := body.Encode(mode)
+		if err != nil {
+			t.Fatalf("mode %d : encode : %s", mode, err)
+		}
+
+		ret, err := BodyDecode(raw, mode)
+		if err != nil {
+			t.Fatalf("mode %d : decode : %s", mode, err)
+		}
+
+		if !bytes.Equal(ret.Payload, body.Payload) {
+			t.Errorf("mode %d : payload %q", mode, ret.Payload)
+		}
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -53,6 +53,30 @@ func Get(key string) interface{} {
 
 /* }}} */
 
+// GetString : Get configuration variable as string
+/* {{{ [config.GetString] Get string variable */
+func GetString(key string) string {
+	return viper.GetString(key)
+}
+
+/* }}} */
+
+// GetInt : Get configuration variable as integer
+/* {{{ [config.GetInt] Get integer variable */
+func GetInt(key string) int {
+	return viper.GetInt(key)
+}
+
+/* }}} */
+
+// GetBool : Get configuration variable as boolean
+/* {{{ [config.GetBool] Get boolean variable */
+func GetBool(key string) bool {
+	return viper.GetBool(key)
+}
+
+/* }}} */
+
 // SetDefault : Set default configuration variable
 /* {{{ [config.SetDefault] Set variable */
 func SetDefault(key string, value interface{}) {
@@ -106,6 +130,45 @@ func init() {
 	viper.SetDefault("storage_service_ssl", true)
 
 	viper.SetDefault("server_addr", ":9797")
+	viper.SetDefault("server_listener", "tcp")
+	viper.SetDefault("server_tls_cert", "")
+	viper.SetDefault("server_tls_key", "")
+	viper.SetDefault("server_tls_client_ca", "")
+	viper.SetDefault("server_unix_path", "/tmp/slater.sock")
+	viper.SetDefault("server_unix_mode", "0660")
+	viper.SetDefault("server_unix_uid", -1)
+	viper.SetDefault("server_unix_gid", -1)
+	viper.SetDefault("server_ws_path", "/")
+	viper.SetDefault("server_ws_origins", "")
+	viper.SetDefault("server_udp_nodelay", true)
+	viper.SetDefault("server_udp_interval", 10)
+	viper.SetDefault("server_udp_resend", 2)
+	viper.SetDefault("server_udp_nc", true)
+	viper.SetDefault("server_udp_sndwnd", 128)
+	viper.SetDefault("server_udp_rcvwnd", 128)
+	viper.SetDefault("server_udp_mtu", 1400)
+	viper.SetDefault("server_udp_max_sessions", 10000)
+	viper.SetDefault("server_udp_timeout", 30000)
+	viper.SetDefault("proxy_protocol", false)
+	viper.SetDefault("proxy_protocol_trusted", "")
+
+	// Message
+	viper.SetDefault("compress_mode", "none")
+	viper.SetDefault("compress_threshold", 256)
+	viper.SetDefault("max_body_length", 4*1024*1024)
+
+	// Server
+	viper.SetDefault("require_online", false)
+	viper.SetDefault("online_max_failures", 3)
+	viper.SetDefault("ack_timeout", 5000)
+	viper.SetDefault("ack_retries", 3)
+	viper.SetDefault("shutdown_timeout", 10000)
+	viper.SetDefault("idle_timeout", 300000)
+	viper.SetDefault("heartbeat_timeout", 0)
+	viper.SetDefault("ping_interval", 0)
+	viper.SetDefault("send_queue_size", 1024)
+	viper.SetDefault("send_queue_policy", "block")
+	viper.SetDefault("send_queue_timeout", 1000)
 
 	return
 }
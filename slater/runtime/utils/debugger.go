@@ -85,9 +85,11 @@ func DebugMessage(msg *engine.Message) error {
 	}
 
 	fmt.Printf("=== Debug message ===\n")
+	fmt.Printf("Message version : %d\n", msg.Version)
 	fmt.Printf("Message type : %d\n", msg.Type)
 	fmt.Printf("Message compress mode : %d\n", msg.CompressMode)
 	fmt.Printf("Message serialize mode : %d\n", msg.SerializeMode)
+	fmt.Printf("Message flags : %04X\n", msg.Flags)
 	fmt.Printf("Body : \n")
 
 	DebugBody(&msg.Body)
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/drnp/slater/slater/runtime/utils"
+)
+
+// ErrAckTimeout : Downward message not acknowledged after retries
+var ErrAckTimeout = errors.New("Downward message not acknowledged")
+
+// pendingMessage : Downward message waiting for DownwardAck
+type pendingMessage struct {
+	data    []byte
+	sentAt  time.Time
+	retries int
+}
+
+// nextSequence : Sequence id of next downward message, never zero
+/* {{{ [nextSequence] */
+func (worker *SlaterWorker) nextSequence() uint32 {
+	seq := atomic.AddUint32(&worker.sequence, 1)
+	if seq == 0 {
+		// Wrapped
+		seq = atomic.AddUint32(&worker.sequence, 1)
+	}
+
+	return seq
+}
+
+/* }}} */
+
+// track : Put streamed downward message into retransmit queue
+/* {{{ [track] */
+func (worker *SlaterWorker) track(seq uint32, data []byte) {
+	worker.pendingLock.Lock()
+	worker.pending[seq] = &pendingMessage{
+		data:   data,
+		sentAt: time.Now(),
+	}
+	worker.pendingLock.Unlock()
+}
+
+/* }}} */
+
+// ack : Remove acknowledged message from retransmit queue
+/* {{{ [ack] */
+func (worker *SlaterWorker) ack(seq uint32) {
+	worker.pendingLock.Lock()
+	delete(worker.pending, seq)
+	worker.pendingLock.Unlock()
+}
+
+/* }}} */
+
+// retransmit : Resend downward messages not acknowledged in AckTimeout,
+// close worker if AckRetries exhausted
+/* {{{ [retransmit] */
+func (worker *SlaterWorker) retransmit() {
+	defer worker.recoverPanic(utils.NewLogger("SLATER WORKER: "))
+
+	timeout := worker.server.AckTimeout
+	ticker := time.NewTicker(tickInterval(timeout))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-worker.closeChan:
+			return
+		case now := <-ticker.C:
+			var (
+				resend  [][]byte
+				expired bool
+			)
+
+			worker.pendingLock.Lock()
+			for _, p := range worker.pending {
+				if now.Sub(p.sentAt) < timeout {
+					continue
+				}
+
+				if p.retries >= worker.server.AckRetries {
+					expired = true
+					break
+				}
+
+				p.retries++
+				p.sentAt = now
+				resend = append(resend, p.data)
+			}
+			worker.pendingLock.Unlock()
+
+			if expired {
+				worker.closeWith(CloseTimeout, ErrAckTimeout)
+				return
+			}
+
+			for _, data := range resend {
+				worker.WriteRaw(data)
+			}
+		}
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
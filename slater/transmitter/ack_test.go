@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+)
+
+// downward : Downward message with JSON payload
+func downward(payload string) *engine.Message {
+	msg := engine.NewMessage(nil)
+	msg.Type = engine.MsgTypeDownward
+	msg.SerializeMode = engine.MsgSerializeJSON
+	msg.Body.Payload = []byte(payload)
+
+	return msg
+}
+
+/* {{{ [TestNextSequence] */
+func TestNextSequence(t *testing.T) {
+	worker := NewWorker(nil, "", nil)
+	worker.sequence = math.MaxUint32 - 1
+	for _, want := range []uint32{math.MaxUint32, 1, 2} {
+		if seq := worker.nextSequence(); seq != want {
+			t.Errorf("got sequence %d, want %d", seq, want)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestUpwardAck] */
+func TestUpwardAck(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		ack  bool
+	}{
+		{"handled", nil, true},
+		{"handler error", errors.New("failed"), false},
+	}
+
+	for _, c := range cases {
+		err := c.err
+		server := &SlaterServer{
+			Authenticate: trustAuthenticate,
+			OnMessage: func(worker *SlaterWorker, msg *engine.Message) error {
+				return err
+			},
+		}
+
+		worker, client := newTestWorker(t, server)
+		client.online(1)
+		client.send(engine.MsgTypeUpward, 42, &engine.Body{})
+		client.send(engine.MsgTypePing, 0, nil)
+
+		msg := client.recv()
+		if c.ack {
+			if msg.Type != engine.MsgTypeUpwardAck || msg.Sequence != 42 {
+				t.Errorf("%s : got type %d sequence %d", c.name, msg.Type, msg.Sequence)
+			}
+
+			msg = client.recv()
+		}
+
+		if msg.Type != engine.MsgTypePong {
+			t.Errorf("%s : got type %d, want pong", c.name, msg.Type)
+		}
+
+		client.conn.Close()
+		waitClosed(t, worker)
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestDownwardAck] */
+func TestDownwardAck(t *testing.T) {
+	cases := []struct {
+		name    string
+		online  bool
+		ack     bool
+		seq     uint32
+		resends int
+		reason  CloseCode
+	}{
+		{"legacy not sequenced", false, false, 0, 0, 0},
+		{"acknowledged", true, true, 1, 0, 0},
+		{"retransmit then timeout", true, false, 1, 2, CloseTimeout},
+	}
+
+	for _, c := range cases {
+		server := &SlaterServer{
+			Authenticate: trustAuthenticate,
+			AckTimeout:   50 * time.Millisecond,
+			AckRetries:   2,
+		}
+
+		worker, client := newTestWorker(t, server)
+		if c.online {
+			client.online(1)
+		}
+
+		worker.WriteMessage(downward(`"hello"`))
+		msg := client.recv()
+		if msg.Type != engine.MsgTypeDownward || msg.Sequence != c.seq {
+			t.Fatalf("%s : got type %d sequence %d", c.name, msg.Type, msg.Sequence)
+		}
+
+		if c.ack {
+			client.send(engine.MsgTypeDownwardAck, msg.Sequence, nil)
+		}
+
+		for i := 0; i < c.resends; i++ {
+			msg = client.recv()
+			if msg == nil || msg.Type != engine.MsgTypeDownward || msg.Sequence != c.seq {
+				t.Fatalf("%s : resend %d expected, got %+v", c.name, i, msg)
+			}
+		}
+
+		if c.reason != 0 {
+			reason := waitClosed(t, worker)
+			if reason.Code != c.reason || reason.Err != ErrAckTimeout {
+				t.Errorf("%s : closed with %s", c.name, reason)
+			}
+
+			continue
+		}
+
+		// Nothing resent, the next frame is pong
+		time.Sleep(3 * server.AckTimeout)
+		client.send(engine.MsgTypePing, 0, nil)
+		if msg = client.recv(); msg.Type != engine.MsgTypePong {
+			t.Errorf("%s : got type %d sequence %d, want pong", c.name, msg.Type, msg.Sequence)
+		}
+
+		client.conn.Close()
+		waitClosed(t, worker)
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
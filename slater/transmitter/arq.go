@@ -0,0 +1,722 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ARQ segment commands
+const (
+	arqCmdPush  = 1
+	arqCmdAck   = 2
+	arqCmdClose = 3
+	// arqCmdDatagram : Unreliable, out of stream
+	arqCmdDatagram = 4
+)
+
+// Segment header : [conv u32][cmd u8][wnd u16][ts u32][sn u32][una u32][len u16]
+const arqHeaderLength = 21
+
+// ARQ parameters
+const (
+	// arqDeadLink : Session broken after transmit times of a segment
+	arqDeadLink = 20
+	// arqLinger : Max time to flush unacknowledged data on close
+	arqLinger = 3 * time.Second
+
+	arqRTODefault = 200
+	arqRTOMin     = 100
+	arqRTONoDelay = 30
+	arqRTOMax     = 60000
+)
+
+// ARQ errors
+var (
+	errARQClosed   = errors.New("Session closed")
+	errARQDeadLink = errors.New("Session dead link, segment retransmitted too many times")
+	errARQTimeout  = errors.New("Session timeout, nothing received from remote")
+
+	errDatagramTooLarge = errors.New("Datagram too large")
+)
+
+// arqEpoch : Base of segment timestamps
+var arqEpoch = time.Now()
+
+// arqClock : Milliseconds since arqEpoch, wraps around
+func arqClock() uint32 {
+	return uint32(time.Since(arqEpoch) / time.Millisecond)
+}
+
+// arqBefore : Sequence / timestamp a is earlier than b, wrap around safe
+func arqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// arqSegment : Reliable segment waiting for ACK
+type arqSegment struct {
+	sn       uint32
+	ts       uint32
+	resendAt uint32
+	rto      uint32
+	xmit     int
+	fastack  int
+	data     []byte
+}
+
+// arqSession : KCP-style ARQ over datagrams, ordered and reliable byte
+// stream of a conversation. Implements io.ReadWriteCloser for worker
+/* {{{ [arqSession] */
+type arqSession struct {
+	conv   uint32
+	addr   string
+	opts   UDPOptions
+	mss    int
+	output func(data []byte) error
+
+	// onClose : Called once after session finalized
+	onClose func()
+
+	// onDatagram : Unreliable datagram received, dropped if nil
+	onDatagram func(data []byte)
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// Send
+	sndQueue [][]byte
+	sndBuf   []*arqSegment
+	sndNxt   uint32
+	sndUna   uint32
+	rmtWnd   uint32
+	cwnd     uint32
+	ssthresh uint32
+	incr     uint32
+
+	// Receive
+	lastRecv uint32
+	rcvNxt   uint32
+	rcvBuf   map[uint32][]byte
+	rcvQueue bytes.Buffer
+	acks     [][2]uint32
+
+	// RTT
+	srtt   int32
+	rttvar int32
+	rto    uint32
+
+	// Close state
+	closing   bool
+	closed    bool
+	closeErr  error
+	lingerEnd time.Time
+	closeChan chan struct{}
+}
+
+// newARQSession : Create session, call run to start it
+/* {{{ [newARQSession] */
+func newARQSession(conv uint32, opts UDPOptions, output func(data []byte) error, onClose func()) *arqSession {
+	opts = opts.normalize()
+	s := &arqSession{
+		conv:      conv,
+		opts:      opts,
+		mss:       opts.MTU - arqHeaderLength,
+		output:    output,
+		onClose:   onClose,
+		rcvBuf:    make(map[uint32][]byte),
+		rmtWnd:    uint32(opts.RcvWnd),
+		cwnd:      1,
+		ssthresh:  2,
+		rto:       arqRTODefault,
+		lastRecv:  arqClock(),
+		closeChan: make(chan struct{}),
+	}
+
+	s.incr = uint32(s.mss)
+	s.cond = sync.NewCond(&s.lock)
+
+	return s
+}
+
+/* }}} */
+
+// run : Flush periodically until session closed
+/* {{{ [run] */
+func (s *arqSession) run() {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeChan:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+/* }}} */
+
+// input : Feed a datagram received from remote
+/* {{{ [input] */
+func (s *arqSession) input(data []byte) error {
+	var (
+		maxAck     uint32
+		hasAck     bool
+		remoteFin  bool
+		datagrams  [][]byte
+		onDatagram func(data []byte)
+	)
+
+	now := arqClock()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return errARQClosed
+	}
+
+	prevUna := s.sndUna
+	onDatagram = s.onDatagram
+	for len(data) >= arqHeaderLength {
+		conv := binary.BigEndian.Uint32(data[0:4])
+		cmd := data[4]
+		wnd := binary.BigEndian.Uint16(data[5:7])
+		ts := binary.BigEndian.Uint32(data[7:11])
+		sn := binary.BigEndian.Uint32(data[11:15])
+		una := binary.BigEndian.Uint32(data[15:19])
+		length := int(binary.BigEndian.Uint16(data[19:21]))
+		data = data[arqHeaderLength:]
+		if conv != s.conv || length > len(data) || length > s.mss {
+			s.lock.Unlock()
+			return errors.New("Invalid segment")
+		}
+
+		payload := data[:length]
+		data = data[length:]
+
+		s.lastRecv = now
+		s.rmtWnd = uint32(wnd)
+		s.parseUna(una)
+		switch cmd {
+		case arqCmdAck:
+			if !arqBefore(now, ts) {
+				s.updateRTT(int32(now - ts))
+			}
+
+			s.parseAck(sn)
+			if !hasAck || arqBefore(maxAck, sn) {
+				maxAck = sn
+				hasAck = true
+			}
+		case arqCmdPush:
+			// Dropped without ACK if reader a window behind, remote
+			// retransmits later
+			if arqBefore(sn, s.rcvNxt+uint32(s.opts.RcvWnd)) && s.rcvQueue.Len() < s.opts.RcvWnd*s.mss {
+				s.acks = append(s.acks, [2]uint32{sn, ts})
+				if _, ok := s.rcvBuf[sn]; !ok && !arqBefore(sn, s.rcvNxt) {
+					s.rcvBuf[sn] = append([]byte(nil), payload...)
+				}
+			}
+		case arqCmdClose:
+			remoteFin = true
+		case arqCmdDatagram:
+			if onDatagram != nil {
+				datagrams = append(datagrams, append([]byte(nil), payload...))
+			}
+		default:
+			s.lock.Unlock()
+			return errors.New("Invalid segment command")
+		}
+	}
+
+	// Move continuous segments to stream
+	for {
+		payload, ok := s.rcvBuf[s.rcvNxt]
+		if !ok {
+			break
+		}
+
+		s.rcvQueue.Write(payload)
+		delete(s.rcvBuf, s.rcvNxt)
+		s.rcvNxt++
+	}
+
+	if hasAck {
+		for _, seg := range s.sndBuf {
+			if arqBefore(seg.sn, maxAck) {
+				seg.fastack++
+			}
+		}
+	}
+
+	if arqBefore(prevUna, s.sndUna) && s.cwnd < s.rmtWnd {
+		// Window growth, slow start then congestion avoidance
+		mss := uint32(s.mss)
+		if s.cwnd < s.ssthresh {
+			s.cwnd++
+			s.incr += mss
+		} else {
+			if s.incr < mss {
+				s.incr = mss
+			}
+
+			s.incr += mss*mss/s.incr + mss/16
+			if (s.cwnd+1)*mss <= s.incr {
+				s.cwnd++
+			}
+		}
+
+		if s.cwnd > s.rmtWnd {
+			s.cwnd = s.rmtWnd
+			s.incr = s.rmtWnd * mss
+		}
+	}
+
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	for _, datagram := range datagrams {
+		onDatagram(datagram)
+	}
+
+	if remoteFin {
+		s.finalize(io.EOF, false)
+	}
+
+	return nil
+}
+
+/* }}} */
+
+// parseUna : Remove segments acknowledged cumulatively
+func (s *arqSession) parseUna(una uint32) {
+	n := 0
+	for _, seg := range s.sndBuf {
+		if !arqBefore(seg.sn, una) {
+			break
+		}
+
+		n++
+	}
+
+	s.sndBuf = s.sndBuf[n:]
+	s.shrink()
+}
+
+// parseAck : Remove segment acknowledged selectively
+func (s *arqSession) parseAck(sn uint32) {
+	for i, seg := range s.sndBuf {
+		if seg.sn == sn {
+			s.sndBuf = append(s.sndBuf[:i], s.sndBuf[i+1:]...)
+			break
+		}
+
+		if arqBefore(sn, seg.sn) {
+			break
+		}
+	}
+
+	s.shrink()
+}
+
+// shrink : Update sndUna
+func (s *arqSession) shrink() {
+	if len(s.sndBuf) > 0 {
+		s.sndUna = s.sndBuf[0].sn
+	} else {
+		s.sndUna = s.sndNxt
+	}
+}
+
+// updateRTT : Smoothed RTT and RTO, as RFC 6298
+func (s *arqSession) updateRTT(rtt int32) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		delta := rtt - s.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+
+		s.rttvar = (3*s.rttvar + delta) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+		if s.srtt < 1 {
+			s.srtt = 1
+		}
+	}
+
+	rto := s.srtt + 4*s.rttvar
+	if interval := int32(s.opts.Interval / time.Millisecond); rto < s.srtt+interval {
+		rto = s.srtt + interval
+	}
+
+	rtoMin := int32(arqRTOMin)
+	if s.opts.NoDelay {
+		rtoMin = arqRTONoDelay
+	}
+
+	if rto < rtoMin {
+		rto = rtoMin
+	} else if rto > arqRTOMax {
+		rto = arqRTOMax
+	}
+
+	s.rto = uint32(rto)
+}
+
+// wndUnused : Free receive window announced to remote
+func (s *arqSession) wndUnused() uint16 {
+	used := len(s.rcvBuf) + (s.rcvQueue.Len()+s.mss-1)/s.mss
+	if used >= s.opts.RcvWnd {
+		return 0
+	}
+
+	return uint16(s.opts.RcvWnd - used)
+}
+
+// flush : Send ACKs, new and timed out (or fast) retransmitting segments
+/* {{{ [flush] */
+func (s *arqSession) flush() {
+	var (
+		packets [][]byte
+		change  bool
+		lost    bool
+		dead    bool
+	)
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+
+	now := arqClock()
+	wnd := s.wndUnused()
+	packet := make([]byte, 0, s.opts.MTU)
+	write := func(cmd byte, ts, sn uint32, data []byte) {
+		if len(packet)+arqHeaderLength+len(data) > s.opts.MTU {
+			packets = append(packets, packet)
+			packet = make([]byte, 0, s.opts.MTU)
+		}
+
+		var header [arqHeaderLength]byte
+		binary.BigEndian.PutUint32(header[0:4], s.conv)
+		header[4] = cmd
+		binary.BigEndian.PutUint16(header[5:7], wnd)
+		binary.BigEndian.PutUint32(header[7:11], ts)
+		binary.BigEndian.PutUint32(header[11:15], sn)
+		binary.BigEndian.PutUint32(header[15:19], s.rcvNxt)
+		binary.BigEndian.PutUint16(header[19:21], uint16(len(data)))
+		packet = append(packet, header[:]...)
+		packet = append(packet, data...)
+	}
+
+	for _, ack := range s.acks {
+		write(arqCmdAck, ack[1], ack[0], nil)
+	}
+
+	s.acks = s.acks[:0]
+
+	// Window
+	cwnd := uint32(s.opts.SndWnd)
+	if s.rmtWnd < cwnd {
+		cwnd = s.rmtWnd
+	}
+
+	if !s.opts.NoCongestion && s.cwnd < cwnd {
+		cwnd = s.cwnd
+	}
+
+	if cwnd == 0 {
+		// Probe remote window
+		cwnd = 1
+	}
+
+	moved := false
+	for len(s.sndQueue) > 0 && arqBefore(s.sndNxt, s.sndUna+cwnd) {
+		s.sndBuf = append(s.sndBuf, &arqSegment{
+			sn:   s.sndNxt,
+			data: s.sndQueue[0],
+		})
+		s.sndQueue[0] = nil
+		s.sndQueue = s.sndQueue[1:]
+		s.sndNxt++
+		moved = true
+	}
+
+	for _, seg := range s.sndBuf {
+		send := false
+		if seg.xmit == 0 {
+			send = true
+			seg.rto = s.rto
+			seg.resendAt = now + seg.rto
+		} else if !arqBefore(now, seg.resendAt) {
+			// Timeout
+			send = true
+			lost = true
+			if s.opts.NoDelay {
+				seg.rto += seg.rto / 2
+			} else {
+				seg.rto += seg.rto
+			}
+
+			if seg.rto > arqRTOMax {
+				seg.rto = arqRTOMax
+			}
+
+			seg.resendAt = now + seg.rto
+		} else if s.opts.FastResend > 0 && seg.fastack >= s.opts.FastResend {
+			// Fast retransmit
+			send = true
+			change = true
+			seg.fastack = 0
+			seg.resendAt = now + seg.rto
+		}
+
+		if send {
+			seg.xmit++
+			seg.ts = now
+			write(arqCmdPush, seg.ts, seg.sn, seg.data)
+			if seg.xmit >= arqDeadLink {
+				dead = true
+			}
+		}
+	}
+
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+
+	// Congestion control
+	if change {
+		s.ssthresh = (s.sndNxt - s.sndUna) / 2
+		if s.ssthresh < 2 {
+			s.ssthresh = 2
+		}
+
+		s.cwnd = s.ssthresh + uint32(s.opts.FastResend)
+		s.incr = s.cwnd * uint32(s.mss)
+	}
+
+	if lost {
+		s.ssthresh = s.cwnd / 2
+		if s.ssthresh < 2 {
+			s.ssthresh = 2
+		}
+
+		s.cwnd = 1
+		s.incr = uint32(s.mss)
+	}
+
+	flushed := s.closing && len(s.sndQueue) == 0 && len(s.sndBuf) == 0
+	expired := s.closing && time.Now().After(s.lingerEnd)
+	silent := now-s.lastRecv >= uint32(s.opts.Timeout/time.Millisecond)
+	if moved {
+		s.cond.Broadcast()
+	}
+
+	s.lock.Unlock()
+
+	for _, packet := range packets {
+		s.output(packet)
+	}
+
+	if dead {
+		s.finalize(errARQDeadLink, true)
+	} else if silent {
+		s.finalize(errARQTimeout, true)
+	} else if flushed || expired {
+		s.finalize(errARQClosed, true)
+	}
+}
+
+/* }}} */
+
+// Read : Read ordered stream, io.EOF if closed by remote
+/* {{{ [Read] */
+func (s *arqSession) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for s.rcvQueue.Len() == 0 && !s.closing && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.rcvQueue.Len() > 0 {
+		return s.rcvQueue.Read(p)
+	}
+
+	if s.closeErr != nil {
+		return 0, s.closeErr
+	}
+
+	return 0, errARQClosed
+}
+
+/* }}} */
+
+// Write : Split data into segments, blocked if send window full
+/* {{{ [Write] */
+func (s *arqSession) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.sndQueue) >= 2*s.opts.SndWnd && !s.closing && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closing || s.closed {
+		return 0, errARQClosed
+	}
+
+	for n := 0; n < len(p); n += s.mss {
+		end := n + s.mss
+		if end > len(p) {
+			end = len(p)
+		}
+
+		s.sndQueue = append(s.sndQueue, append([]byte(nil), p[n:end]...))
+	}
+
+	return len(p), nil
+}
+
+/* }}} */
+
+// WriteDatagram : Send data as one unreliable segment, bypass window
+// and retransmission
+/* {{{ [WriteDatagram] */
+func (s *arqSession) WriteDatagram(data []byte) error {
+	s.lock.Lock()
+	if s.closing || s.closed {
+		s.lock.Unlock()
+		return errARQClosed
+	}
+
+	if len(data) > s.mss {
+		s.lock.Unlock()
+		return errDatagramTooLarge
+	}
+
+	packet := make([]byte, arqHeaderLength, arqHeaderLength+len(data))
+	binary.BigEndian.PutUint32(packet[0:4], s.conv)
+	packet[4] = arqCmdDatagram
+	binary.BigEndian.PutUint16(packet[5:7], s.wndUnused())
+	binary.BigEndian.PutUint32(packet[7:11], arqClock())
+	binary.BigEndian.PutUint32(packet[15:19], s.rcvNxt)
+	binary.BigEndian.PutUint16(packet[19:21], uint16(len(data)))
+	packet = append(packet, data...)
+	s.lock.Unlock()
+
+	return s.output(packet)
+}
+
+/* }}} */
+
+// OnDatagram : Set handler of unreliable datagrams received
+/* {{{ [OnDatagram] */
+func (s *arqSession) OnDatagram(handler func(data []byte)) {
+	s.lock.Lock()
+	s.onDatagram = handler
+	s.lock.Unlock()
+}
+
+/* }}} */
+
+// Close : Stop reading and writing, session finalized after pending data
+// acknowledged or arqLinger passed
+/* {{{ [Close] */
+func (s *arqSession) Close() error {
+	s.lock.Lock()
+	if s.closing || s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+
+	s.closing = true
+	s.lingerEnd = time.Now().Add(arqLinger)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	// Flush at once, finalized if nothing pending
+	s.flush()
+
+	return nil
+}
+
+/* }}} */
+
+// finalize : Close session, tell remote if notify
+/* {{{ [finalize] */
+func (s *arqSession) finalize(err error, notify bool) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+
+	s.closed = true
+	if s.closeErr == nil {
+		s.closeErr = err
+	}
+
+	s.cond.Broadcast()
+	close(s.closeChan)
+	s.lock.Unlock()
+
+	if notify {
+		var fin [arqHeaderLength]byte
+		binary.BigEndian.PutUint32(fin[0:4], s.conv)
+		fin[4] = arqCmdClose
+		s.output(fin[:])
+	}
+
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+	"github.com/drnp/slater/slater/runtime/utils"
+)
+
+// Timeout errors, reason of worker closed by watchdog
+var (
+	ErrIdleTimeout      = errors.New("Read idle timeout")
+	ErrHeartbeatTimeout = errors.New("Heartbeat timeout")
+)
+
+// minTickInterval : Shortest period of timeout checks
+const minTickInterval = 10 * time.Millisecond
+
+// tickInterval : Check period of timeout d, half of d but no less than
+// minTickInterval
+/* {{{ [tickInterval] */
+func tickInterval(d time.Duration) time.Duration {
+	if d/2 < minTickInterval {
+		return minTickInterval
+	}
+
+	return d / 2
+}
+
+/* }}} */
+
+// touchRecv : Data received from client
+/* {{{ [touchRecv] */
+func (worker *SlaterWorker) touchRecv() {
+	atomic.StoreInt64(&worker.lastRecv, time.Now().UnixNano())
+}
+
+/* }}} */
+
+// touchHeartbeat : Ping or Pong received from client
+/* {{{ [touchHeartbeat] */
+func (worker *SlaterWorker) touchHeartbeat() {
+	atomic.StoreInt64(&worker.lastHeartbeat, time.Now().UnixNano())
+}
+
+/* }}} */
+
+// watchdog : Close worker idle longer than IdleTimeout or without
+// heartbeat in HeartbeatTimeout, send Ping every PingInterval
+/* {{{ [watchdog] */
+func (worker *SlaterWorker) watchdog() {
+	defer worker.recoverPanic(utils.NewLogger("SLATER WORKER: "))
+
+	server := worker.server
+	interval := time.Duration(0)
+	for _, d := range []time.Duration{server.IdleTimeout, server.HeartbeatTimeout, server.PingInterval} {
+		if d > 0 && (interval == 0 || d < interval) {
+			interval = d
+		}
+	}
+
+	ticker := time.NewTicker(tickInterval(interval))
+	defer ticker.Stop()
+
+	lastPing := time.Now()
+	for {
+		select {
+		case <-worker.closeChan:
+			return
+		case now := <-ticker.C:
+			lastRecv := time.Unix(0, atomic.LoadInt64(&worker.lastRecv))
+			if server.IdleTimeout > 0 && now.Sub(lastRecv) > server.IdleTimeout {
+				worker.closeWith(CloseTimeout, ErrIdleTimeout)
+				return
+			}
+
+			lastHeartbeat := time.Unix(0, atomic.LoadInt64(&worker.lastHeartbeat))
+			if server.HeartbeatTimeout > 0 && now.Sub(lastHeartbeat) > server.HeartbeatTimeout {
+				worker.closeWith(CloseTimeout, ErrHeartbeatTimeout)
+				return
+			}
+
+			if server.PingInterval > 0 && now.Sub(lastPing) >= server.PingInterval {
+				// Server-initiated ping, client answers Pong
+				lastPing = now
+				ping := engine.NewMessage(nil)
+				ping.Type = engine.MsgTypePing
+				worker.WriteMessage(ping)
+			}
+		}
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+)
+
+/* {{{ [TestTickInterval] */
+func TestTickInterval(t *testing.T) {
+	cases := []struct {
+		d    time.Duration
+		want time.Duration
+	}{
+		{time.Nanosecond, minTickInterval},
+		{minTickInterval, minTickInterval},
+		{2 * minTickInterval, minTickInterval},
+		{time.Second, 500 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		if got := tickInterval(c.d); got != c.want {
+			t.Errorf("%s : got %s, want %s", c.d, got, c.want)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestWatchdog] */
+func TestWatchdog(t *testing.T) {
+	cases := []struct {
+		name   string
+		server *SlaterServer
+		err    error
+	}{
+		{"idle", &SlaterServer{IdleTimeout: time.Nanosecond}, ErrIdleTimeout},
+		{"heartbeat", &SlaterServer{HeartbeatTimeout: 30 * time.Millisecond}, ErrHeartbeatTimeout},
+		{"ack", &SlaterServer{AckTimeout: time.Nanosecond}, ErrAckTimeout},
+	}
+
+	for _, c := range cases {
+		c.server.Authenticate = trustAuthenticate
+		worker, client := newTestWorker(t, c.server)
+		if c.err == ErrAckTimeout {
+			client.online(1)
+			worker.WriteMessage(downward(`"x"`))
+		}
+
+		if reason := waitClosed(t, worker); reason.Code != CloseTimeout || reason.Err != c.err {
+			t.Errorf("%s : closed with %s", c.name, reason)
+		}
+
+		client.conn.Close()
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestServerPing] */
+func TestServerPing(t *testing.T) {
+	server := &SlaterServer{
+		PingInterval:     20 * time.Millisecond,
+		HeartbeatTimeout: 100 * time.Millisecond,
+	}
+
+	worker, client := newTestWorker(t, server)
+
+	// Answer pings for a while, longer than heartbeat timeout
+	deadline := time.Now().Add(3 * server.HeartbeatTimeout)
+	for time.Now().Before(deadline) {
+		msg := client.recv()
+		if msg == nil || msg.Type != engine.MsgTypePing {
+			t.Fatalf("ping expected, got %+v", msg)
+		}
+
+		client.send(engine.MsgTypePong, 0, nil)
+	}
+
+	if worker.isClosed() {
+		t.Fatalf("closed with %s", worker.CloseReason())
+	}
+
+	// Stop answering
+	go io.Copy(io.Discard, client.conn)
+
+	if reason := waitClosed(t, worker); reason.Err != ErrHeartbeatTimeout {
+		t.Errorf("closed with %s", reason)
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+	"github.com/drnp/slater/slater/runtime/utils"
+)
+
+// Middleware : Wrapper around OnMessageHandler, call next to continue
+type Middleware func(next OnMessageHandler) OnMessageHandler
+
+// Chain : Wrap handler with middlewares, the first one is the outermost
+/* {{{ [Chain] */
+func Chain(handler OnMessageHandler, middlewares ...Middleware) OnMessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i] != nil {
+			handler = middlewares[i](handler)
+		}
+	}
+
+	return handler
+}
+
+/* }}} */
+
+// RecoveryMiddleware : Recover panic of handler, return it as error
+/* {{{ [RecoveryMiddleware] */
+func RecoveryMiddleware(next OnMessageHandler) OnMessageHandler {
+	logger := utils.NewLogger("SLATER RECOVERY: ")
+
+	return func(worker *SlaterWorker, msg *engine.Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Printf("Client %s (UID %d) panic : %v\n%s", worker.Addr, worker.UID(), r, debug.Stack())
+				err = fmt.Errorf("Handler panic : %v", r)
+			}
+		}()
+
+		return next(worker, msg)
+	}
+}
+
+/* }}} */
+
+// TimingMiddleware : Log time cost of handler
+/* {{{ [TimingMiddleware] */
+func TimingMiddleware(next OnMessageHandler) OnMessageHandler {
+	logger := utils.NewLogger("SLATER TIMING: ")
+
+	return func(worker *SlaterWorker, msg *engine.Message) error {
+		start := time.Now()
+		err := next(worker, msg)
+		logger.Printf("Client %s message type %d handled in %s\n", worker.Addr, msg.Type, time.Since(start))
+
+		return err
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/drnp/slater/slater/engine"
+)
+
+/* {{{ [TestChain] */
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next OnMessageHandler) OnMessageHandler {
+			return func(worker *SlaterWorker, msg *engine.Message) error {
+				calls = append(calls, name)
+				err := next(worker, msg)
+				calls = append(calls, name+" done")
+
+				return err
+			}
+		}
+	}
+
+	errHandler := errors.New("handler")
+	handler := func(worker *SlaterWorker, msg *engine.Message) error {
+		calls = append(calls, "handler")
+		return errHandler
+	}
+
+	cases := []struct {
+		name        string
+		middlewares []Middleware
+		calls       []string
+	}{
+		{"none", nil, []string{"handler"}},
+		{"nil skipped", []Middleware{nil}, []string{"handler"}},
+		{"first outermost", []Middleware{trace("a"), nil, trace("b")},
+			[]string{"a", "b", "handler", "b done", "a done"}},
+	}
+
+	for _, c := range cases {
+		calls = nil
+		if err := Chain(handler, c.middlewares...)(nil, nil); err != errHandler {
+			t.Errorf("%s : error %v not passed through", c.name, err)
+		}
+
+		if !reflect.DeepEqual(calls, c.calls) {
+			t.Errorf("%s : calls %v, want %v", c.name, calls, c.calls)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestRecoveryMiddleware] */
+func TestRecoveryMiddleware(t *testing.T) {
+	handled := make(chan error, 1)
+	server := &SlaterServer{
+		OnMessage: func(worker *SlaterWorker, msg *engine.Message) error {
+			panic("handler bug")
+		},
+		Middlewares: []Middleware{
+			func(next OnMessageHandler) OnMessageHandler {
+				return func(worker *SlaterWorker, msg *engine.Message) error {
+					err := next(worker, msg)
+					handled <- err
+
+					return err
+				}
+			},
+			RecoveryMiddleware,
+		},
+	}
+
+	worker, client := newTestWorker(t, server)
+	client.send(engine.MsgTypeUpward, 1, &engine.Body{App: "test"})
+	if err := <-handled; err == nil {
+		t.Error("panic not returned as error")
+	}
+
+	// Worker still serving, no ACK for failed message
+	client.send(engine.MsgTypePing, 0, nil)
+	if m := client.recv(); m == nil || m.Type != engine.MsgTypePong {
+		t.Fatalf("got %+v, want pong", m)
+	}
+
+	if reason := worker.CloseReason(); reason != nil {
+		t.Errorf("worker closed : %s", reason)
+	}
+
+	client.conn.Close()
+	waitClosed(t, worker)
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,420 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drnp/slater/slater/runtime/utils"
+)
+
+// proxyV2Signature : The first 12 bytes of PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength : Max length of v1 header line, CRLF included
+const proxyV1MaxLength = 107
+
+// DefaultProxyHeaderTimeout : Max wait of PROXY header from trusted source
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// ErrNoTrustedSource : PROXY protocol enabled without trusted sources
+var ErrNoTrustedSource = errors.New("PROXY protocol requires trusted sources")
+
+// ProxyProtocol : HAProxy PROXY protocol v1 / v2 on stream listeners.
+// Connections from trusted sources must start with PROXY header, whose
+// source address replaces the remote address of connection. Others are
+// served as is
+type ProxyProtocol struct {
+	// Trusted : Allowed sources (load balancers), nobody if empty. Peers
+	// without IP address (UNIX socket) trusted unless empty
+	Trusted []*net.IPNet
+
+	// Timeout : Max wait of header
+	// DefaultProxyHeaderTimeout used if 0
+	Timeout time.Duration
+}
+
+// NewProxyProtocol : Create PROXY protocol options, trusted sources given
+// in CIDR or single IP. ErrNoTrustedSource if none given
+/* {{{ [NewProxyProtocol] */
+func NewProxyProtocol(trusted []string) (*ProxyProtocol, error) {
+	if len(trusted) == 0 {
+		return nil, ErrNoTrustedSource
+	}
+
+	p := &ProxyProtocol{}
+	for _, source := range trusted {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted source [%s]", source)
+			}
+
+			if ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted source [%s]", source)
+		}
+
+		p.Trusted = append(p.Trusted, ipNet)
+	}
+
+	return p, nil
+}
+
+/* }}} */
+
+// trusted : Remote address in allowlist
+/* {{{ [trusted] */
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	if len(p.Trusted) == 0 {
+		return false
+	}
+
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// UNIX socket peer
+		return true
+	}
+
+	for _, ipNet := range p.Trusted {
+		if ipNet.Contains(a.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* }}} */
+
+// proxyOption : Embedded by listeners supporting PROXY protocol
+type proxyOption struct {
+	proxy *ProxyProtocol
+}
+
+func (po *proxyOption) setProxy(p *ProxyProtocol) {
+	po.proxy = p
+}
+
+// wrap : Parse PROXY header of connections accepted from l
+func (po *proxyOption) wrap(l net.Listener) net.Listener {
+	if po.proxy == nil || l == nil {
+		return l
+	}
+
+	return &proxyListener{
+		Listener:  l,
+		proxy:     po.proxy,
+		connChan:  make(chan net.Conn),
+		errChan:   make(chan error),
+		closeChan: make(chan struct{}),
+	}
+}
+
+// proxySetter : Listener supporting PROXY protocol
+type proxySetter interface {
+	setProxy(p *ProxyProtocol)
+}
+
+// proxyListener : net.Listener reading PROXY header of each connection in
+// its own goroutine, a slow source never blocks others
+/* {{{ [proxyListener] */
+type proxyListener struct {
+	net.Listener
+	proxy *ProxyProtocol
+
+	serveOnce sync.Once
+	closeOnce sync.Once
+	connChan  chan net.Conn
+	errChan   chan error
+	closeChan chan struct{}
+}
+
+// Accept : Connections with broken header dropped, never returned as error
+// (which makes server back off)
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	pl.serveOnce.Do(func() {
+		go pl.serve()
+	})
+
+	select {
+	case c := <-pl.connChan:
+		return c, nil
+	case err := <-pl.errChan:
+		return nil, err
+	case <-pl.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *proxyListener) Close() error {
+	pl.closeOnce.Do(func() {
+		close(pl.closeChan)
+	})
+
+	return pl.Listener.Close()
+}
+
+// serve : Accept from inner listener until closed
+func (pl *proxyListener) serve() {
+	for {
+		c, err := pl.Listener.Accept()
+		if err != nil {
+			select {
+			case pl.errChan <- err:
+				continue
+			case <-pl.closeChan:
+				return
+			}
+		}
+
+		if pl.proxy.trusted(c.RemoteAddr()) {
+			go pl.handshake(c)
+		} else {
+			pl.deliver(c)
+		}
+	}
+}
+
+// handshake : Read header with timeout, connection closed on failure
+func (pl *proxyListener) handshake(c net.Conn) {
+	timeout := pl.proxy.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	pc, err := readProxyHeader(c)
+	if err != nil {
+		utils.NewLogger("SLATER PROXY: ").Printf("Client %s : %s\n", c.RemoteAddr().String(), err.Error())
+		c.Close()
+		return
+	}
+
+	c.SetReadDeadline(time.Time{})
+	pl.deliver(pc)
+}
+
+// deliver : Hand connection to Accept, closed if listener closed
+func (pl *proxyListener) deliver(c net.Conn) {
+	select {
+	case pl.connChan <- c:
+	case <-pl.closeChan:
+		c.Close()
+	}
+}
+
+/* }}} */
+
+// proxyConn : Connection with source address from PROXY header
+/* {{{ [proxyConn] */
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	return pc.r.Read(p)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+/* }}} */
+
+// readProxyHeader : Parse v1 or v2 header, remote address kept for
+// UNKNOWN (v1) or LOCAL (v2) connection
+/* {{{ [readProxyHeader] */
+func readProxyHeader(c net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{
+		Conn:   c,
+		r:      bufio.NewReader(c),
+		remote: c.RemoteAddr(),
+	}
+
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	switch first[0] {
+	case 'P':
+		remote, err = readProxyV1(pc.r)
+	case proxyV2Signature[0]:
+		remote, err = readProxyV2(pc.r)
+	default:
+		err = errors.New("PROXY header required")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if remote != nil {
+		pc.remote = remote
+	}
+
+	return pc, nil
+}
+
+/* }}} */
+
+// readProxyV1 : PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n
+/* {{{ [readProxyV1] */
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("Invalid PROXY v1 header")
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("Invalid PROXY v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("Invalid PROXY v1 source address")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+/* }}} */
+
+// readProxyV2 : Binary header, TLVs skipped
+/* {{{ [readProxyV2] */
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("Invalid PROXY v2 signature")
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, errors.New("Unsupported PROXY v2 version")
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0xF {
+	case 0:
+		// LOCAL, health check of proxy itself
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, errors.New("Unsupported PROXY v2 command")
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		// AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("PROXY v2 address too short")
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 2:
+		// AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("PROXY v2 address too short")
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	}
+
+	// AF_UNSPEC / AF_UNIX
+	return nil, nil
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
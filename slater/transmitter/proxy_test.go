@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyV2 : Binary header of given command, family and address block
+func proxyV2(command, family byte, addr []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addr)))
+
+	return append(header, addr...)
+}
+
+// pipeConn : net.Conn over net.Pipe with TCP remote address
+type pipeConn struct {
+	net.Conn
+}
+
+func (pc *pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+}
+
+/* {{{ [TestReadProxyHeader] */
+func TestReadProxyHeader(t *testing.T) {
+	inet := make([]byte, 12)
+	copy(inet, net.IPv4(192, 0, 2, 1).To4())
+	binary.BigEndian.PutUint16(inet[8:10], 5000)
+
+	inet6 := make([]byte, 36)
+	copy(inet6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(inet6[32:34], 6000)
+
+	badVersion := proxyV2(1, 1, inet)
+	badVersion[12] = 0x31
+
+	cases := []struct {
+		name   string
+		header []byte
+		remote string
+		fail   bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\n"), "192.0.2.1:5000", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 6000 80\r\n"), "[2001:db8::1]:6000", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "10.0.0.1:4000", false},
+		{"v1 bad protocol", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 5000 80\r\n"), "", true},
+		{"v1 bad address", []byte("PROXY TCP4 foo 192.0.2.2 5000 80\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 70000 80\r\n"), "", true},
+		{"v1 too long", append([]byte("PROXY "), bytes.Repeat([]byte("x"), proxyV1MaxLength)...), "", true},
+		{"v2 inet", proxyV2(1, 1, inet), "192.0.2.1:5000", false},
+		{"v2 inet6", proxyV2(1, 2, inet6), "[2001:db8::1]:6000", false},
+		{"v2 local", proxyV2(0, 0, nil), "10.0.0.1:4000", false},
+		{"v2 unspec", proxyV2(1, 0, nil), "10.0.0.1:4000", false},
+		{"v2 tlv skipped", proxyV2(1, 1, append(inet, 0x04, 0, 1, 'x')), "192.0.2.1:5000", false},
+		{"v2 short address", proxyV2(1, 1, inet[:8]), "", true},
+		{"v2 bad version", badVersion, "", true},
+		{"v2 bad command", proxyV2(2, 1, inet), "", true},
+		{"v2 bad signature", append([]byte("\r\n\r\nxxxxxxxxxxxx"), 0, 0), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", true},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(append(c.header, "payload"...))
+			client.Close()
+		}()
+
+		pc, err := readProxyHeader(&pipeConn{server})
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s : header accepted", c.name)
+			}
+
+			server.Close()
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s : %s", c.name, err)
+		} else if pc.RemoteAddr().String() != c.remote {
+			t.Errorf("%s : remote %s, want %s", c.name, pc.RemoteAddr(), c.remote)
+		} else if data, _ := io.ReadAll(pc); string(data) != "payload" {
+			t.Errorf("%s : data %q after header", c.name, data)
+		}
+
+		server.Close()
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestProxyTrusted] */
+func TestProxyTrusted(t *testing.T) {
+	if _, err := NewProxyProtocol(nil); err != ErrNoTrustedSource {
+		t.Errorf("no trusted source : %v", err)
+	}
+
+	if _, err := NewProxyProtocol([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid source accepted")
+	}
+
+	p, err := NewProxyProtocol([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		proxy   *ProxyProtocol
+		addr    net.Addr
+		trusted bool
+	}{
+		{p, &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3)}, true},
+		{p, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, true},
+		{p, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2)}, false},
+		{p, &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{p, &net.TCPAddr{IP: net.ParseIP("2001:db8::2")}, false},
+		{p, &net.UnixAddr{Name: "@", Net: "unix"}, true},
+		{&ProxyProtocol{}, &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3)}, false},
+		{&ProxyProtocol{}, &net.UnixAddr{Name: "@", Net: "unix"}, false},
+	}
+
+	for _, c := range cases {
+		if c.proxy.trusted(c.addr) != c.trusted {
+			t.Errorf("%s (%d sources) : trusted %v, want %v", c.addr, len(c.proxy.Trusted), !c.trusted, c.trusted)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestProxyListener] */
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := NewProxyProtocol([]string{"127.0.0.1"})
+	po := &proxyOption{}
+	po.setProxy(p)
+	pl := po.wrap(l)
+	addr := l.Addr().String()
+
+	// Silent source waiting for header timeout
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\r\nping"))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := pl.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+
+		accepted <- conn
+	}()
+
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			t.Fatal("accept failed")
+		}
+
+		defer conn.Close()
+		if conn.RemoteAddr().String() != "192.0.2.1:5000" {
+			t.Errorf("remote %s", conn.RemoteAddr())
+		}
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("data %q : %v", buf, err)
+		}
+	case <-time.After(DefaultProxyHeaderTimeout / 2):
+		t.Fatal("accept blocked by silent source")
+	}
+
+	// Close unblocks Accept
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pl.Close()
+	}()
+
+	if _, err := pl.Accept(); err == nil {
+		t.Error("accept after close")
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestProxyUntrusted] */
+func TestProxyUntrusted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := NewProxyProtocol([]string{"192.0.2.0/24"})
+	po := &proxyOption{}
+	po.setProxy(p)
+	pl := po.wrap(l)
+	defer pl.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+	header := "PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\r\n"
+	c.Write([]byte(header))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	if conn.RemoteAddr().String() != c.LocalAddr().String() {
+		t.Errorf("remote %s, want %s", conn.RemoteAddr(), c.LocalAddr())
+	}
+
+	// Header from untrusted peer passed as data
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != header {
+		t.Errorf("data %q : %v", buf, err)
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,385 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueuePolicy : Behavior of WriteMessage when send queue of worker full
+type QueuePolicy byte
+
+// Send queue overflow policies
+const (
+	// QueuePolicyBlock : Wait for free slot, ErrQueueTimeout after timeout
+	QueuePolicyBlock QueuePolicy = iota
+	// QueuePolicyDropOldest : Discard the oldest queued data
+	QueuePolicyDropOldest
+	// QueuePolicyDisconnect : Close slow consumer with ErrSlowConsumer
+	QueuePolicyDisconnect
+)
+
+// Defaults of send queue
+const (
+	DefaultSendQueueSize    = 1024
+	DefaultSendQueueTimeout = time.Second
+)
+
+// maxCoalesceSize : Writer stops merging queued frames beyond this size
+const maxCoalesceSize = 64 * 1024
+
+// Send queue errors
+var (
+	ErrQueueTimeout = errors.New("Send queue full, timeout")
+	ErrSlowConsumer = errors.New("Send queue full, slow consumer")
+	ErrWorkerClosed = errors.New("Worker closed")
+)
+
+// QueueMetrics : Send queue statistics
+type QueueMetrics struct {
+	// Depth : Data waiting in queue
+	Depth int
+	// Capacity : Size of queue
+	Capacity int
+	// HighWater : Max depth ever reached
+	HighWater int
+	// Dropped : Data discarded by QueuePolicyDropOldest
+	Dropped uint64
+	// Timeouts : Writes failed by QueuePolicyBlock timeout
+	Timeouts uint64
+	// Disconnected : Workers closed by QueuePolicyDisconnect
+	Disconnected uint64
+}
+
+// queueCounters : Overflow counters, kept by both worker and server
+type queueCounters struct {
+	dropped      uint64
+	timeouts     uint64
+	disconnected uint64
+}
+
+// sendQueue : Bounded outbound queue of worker
+type sendQueue struct {
+	ch      chan []byte
+	policy  QueuePolicy
+	timeout time.Duration
+
+	// pending : Queued and being written
+	pending   int64
+	highWater int64
+	counters  queueCounters
+
+	// backlog : Data waiting for room of full queue, see enqueueAsync
+	backlog     [][]byte
+	backlogLock sync.Mutex
+}
+
+// QueuePolicyByName : Get queue policy by name
+/* {{{ [QueuePolicyByName] */
+func QueuePolicyByName(name string) (QueuePolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "block":
+		return QueuePolicyBlock, nil
+	case "drop_oldest":
+		return QueuePolicyDropOldest, nil
+	case "disconnect":
+		return QueuePolicyDisconnect, nil
+	}
+
+	return QueuePolicyBlock, errors.New("Unsupported send queue policy")
+}
+
+/* }}} */
+
+// newSendQueue : Create send queue, defaults used for zero values
+/* {{{ [newSendQueue] */
+func newSendQueue(size int, policy QueuePolicy, timeout time.Duration) *sendQueue {
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultSendQueueTimeout
+	}
+
+	return &sendQueue{
+		ch:      make(chan []byte, size),
+		policy:  policy,
+		timeout: timeout,
+	}
+}
+
+/* }}} */
+
+// enqueue : Put data into send queue of worker, overflow handled by policy
+/* {{{ [enqueue] */
+func (worker *SlaterWorker) enqueue(data []byte) error {
+	q := worker.sendQueue
+	if worker.isClosed() {
+		return ErrWorkerClosed
+	}
+
+	select {
+	case q.ch <- data:
+		q.queued()
+		return nil
+	default:
+	}
+
+	// Full
+	switch q.policy {
+	case QueuePolicyDropOldest:
+		for {
+			select {
+			case <-q.ch:
+				atomic.AddInt64(&q.pending, -1)
+				worker.countQueue(func(c *queueCounters) { atomic.AddUint64(&c.dropped, 1) })
+			default:
+			}
+
+			select {
+			case q.ch <- data:
+				q.queued()
+				return nil
+			default:
+			}
+		}
+	case QueuePolicyDisconnect:
+		worker.countQueue(func(c *queueCounters) { atomic.AddUint64(&c.disconnected, 1) })
+		worker.closeWith(CloseSlowConsumer, ErrSlowConsumer)
+
+		return ErrSlowConsumer
+	default:
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		select {
+		case q.ch <- data:
+			q.queued()
+			return nil
+		case <-worker.closeChan:
+			return ErrWorkerClosed
+		case <-timer.C:
+			worker.countQueue(func(c *queueCounters) { atomic.AddUint64(&c.timeouts, 1) })
+			return ErrQueueTimeout
+		}
+	}
+}
+
+/* }}} */
+
+// enqueueAsync : Put data into send queue without waiting. Data cannot be
+// queued immediately under QueuePolicyBlock is kept in backlog, and queued
+// in order by a background goroutine of worker, so a slow worker never
+// stalls the caller. Backlog no longer than queue, ErrQueueTimeout if full
+/* {{{ [enqueueAsync] */
+func (worker *SlaterWorker) enqueueAsync(data []byte) error {
+	q := worker.sendQueue
+	if q.policy != QueuePolicyBlock {
+		// Never wait
+		return worker.enqueue(data)
+	}
+
+	if worker.isClosed() {
+		return ErrWorkerClosed
+	}
+
+	q.backlogLock.Lock()
+	defer q.backlogLock.Unlock()
+	if len(q.backlog) == 0 {
+		select {
+		case q.ch <- data:
+			q.queued()
+			return nil
+		default:
+		}
+
+		go worker.flushBacklog()
+	} else if len(q.backlog) >= cap(q.ch) {
+		worker.countQueue(func(c *queueCounters) { atomic.AddUint64(&c.timeouts, 1) })
+		return ErrQueueTimeout
+	}
+
+	q.backlog = append(q.backlog, data)
+
+	return nil
+}
+
+/* }}} */
+
+// flushBacklog : Move backlog into send queue, the rest dropped once
+// enqueue failed. Exits when backlog empty
+/* {{{ [flushBacklog] */
+func (worker *SlaterWorker) flushBacklog() {
+	q := worker.sendQueue
+	for {
+		q.backlogLock.Lock()
+		if len(q.backlog) == 0 {
+			q.backlogLock.Unlock()
+			return
+		}
+
+		data := q.backlog[0]
+		q.backlogLock.Unlock()
+
+		err := worker.enqueue(data)
+
+		q.backlogLock.Lock()
+		if err != nil || len(q.backlog) == 0 {
+			// Failed, or discarded meanwhile
+			q.backlog = nil
+		} else {
+			q.backlog[0] = nil
+			q.backlog = q.backlog[1:]
+		}
+		q.backlogLock.Unlock()
+	}
+}
+
+/* }}} */
+
+// discard : Drop data left in backlog and queue of closed worker
+/* {{{ [discard] */
+func (q *sendQueue) discard() {
+	q.backlogLock.Lock()
+	q.backlog = nil
+	q.backlogLock.Unlock()
+
+	for {
+		select {
+		case <-q.ch:
+			atomic.AddInt64(&q.pending, -1)
+		default:
+			return
+		}
+	}
+}
+
+/* }}} */
+
+// backlogLen : Amount of data in backlog
+/* {{{ [backlogLen] */
+func (q *sendQueue) backlogLen() int {
+	q.backlogLock.Lock()
+	defer q.backlogLock.Unlock()
+
+	return len(q.backlog)
+}
+
+/* }}} */
+
+// countQueue : Update overflow counters of worker and server
+/* {{{ [countQueue] */
+func (worker *SlaterWorker) countQueue(fn func(c *queueCounters)) {
+	fn(&worker.sendQueue.counters)
+	if worker.server != nil {
+		fn(&worker.server.queueCounters)
+	}
+}
+
+/* }}} */
+
+// queued : Count data put into queue
+/* {{{ [queued] */
+func (q *sendQueue) queued() {
+	pending := atomic.AddInt64(&q.pending, 1)
+	for {
+		high := atomic.LoadInt64(&q.highWater)
+		if pending <= high || atomic.CompareAndSwapInt64(&q.highWater, high, pending) {
+			return
+		}
+	}
+}
+
+/* }}} */
+
+// sent : Count n data written out
+/* {{{ [sent] */
+func (q *sendQueue) sent(n int) {
+	atomic.AddInt64(&q.pending, -int64(n))
+}
+
+/* }}} */
+
+// QueueMetrics : Send queue statistics of worker
+/* {{{ [QueueMetrics] */
+func (worker *SlaterWorker) QueueMetrics() QueueMetrics {
+	q := worker.sendQueue
+
+	return QueueMetrics{
+		Depth:        len(q.ch) + q.backlogLen(),
+		Capacity:     cap(q.ch),
+		HighWater:    int(atomic.LoadInt64(&q.highWater)),
+		Dropped:      atomic.LoadUint64(&q.counters.dropped),
+		Timeouts:     atomic.LoadUint64(&q.counters.timeouts),
+		Disconnected: atomic.LoadUint64(&q.counters.disconnected),
+	}
+}
+
+/* }}} */
+
+// QueueMetrics : Send queue statistics of server. Depth and Capacity
+// summed over live workers, HighWater is the max one. Counters include
+// closed workers
+/* {{{ [QueueMetrics] */
+func (server *SlaterServer) QueueMetrics() QueueMetrics {
+	ret := QueueMetrics{
+		Dropped:      atomic.LoadUint64(&server.queueCounters.dropped),
+		Timeouts:     atomic.LoadUint64(&server.queueCounters.timeouts),
+		Disconnected: atomic.LoadUint64(&server.queueCounters.disconnected),
+	}
+
+	server.Workers.Range(func(worker *SlaterWorker) bool {
+		m := worker.QueueMetrics()
+		ret.Depth += m.Depth
+		ret.Capacity += m.Capacity
+		if m.HighWater > ret.HighWater {
+			ret.HighWater = m.HighWater
+		}
+
+		return true
+	})
+
+	return ret
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
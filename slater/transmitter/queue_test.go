@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* {{{ [TestQueuePolicyByName] */
+func TestQueuePolicyByName(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy QueuePolicy
+		fail   bool
+	}{
+		{"", QueuePolicyBlock, false},
+		{"Block", QueuePolicyBlock, false},
+		{"drop_oldest", QueuePolicyDropOldest, false},
+		{"disconnect", QueuePolicyDisconnect, false},
+		{"drop_newest", QueuePolicyBlock, true},
+	}
+
+	for _, c := range cases {
+		policy, err := QueuePolicyByName(c.name)
+		if policy != c.policy || (err != nil) != c.fail {
+			t.Errorf("%q : got %d, %v", c.name, policy, err)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestQueueOverflow] */
+func TestQueueOverflow(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  QueuePolicy
+		err     error
+		depth   int
+		metrics QueueMetrics
+	}{
+		{"block", QueuePolicyBlock, ErrQueueTimeout, 2, QueueMetrics{Timeouts: 1}},
+		{"drop oldest", QueuePolicyDropOldest, nil, 2, QueueMetrics{Dropped: 1}},
+		{"disconnect", QueuePolicyDisconnect, ErrSlowConsumer, 0, QueueMetrics{Disconnected: 1}},
+	}
+
+	for _, c := range cases {
+		server := &SlaterServer{
+			SendQueueSize:    2,
+			SendQueuePolicy:  c.policy,
+			SendQueueTimeout: 20 * time.Millisecond,
+		}
+
+		// Not driven, nothing taken from queue
+		s, _ := net.Pipe()
+		worker := NewWorker(server, "queue", s)
+		for _, data := range []string{"1", "2"} {
+			if err := worker.WriteRaw([]byte(data)); err != nil {
+				t.Fatalf("%s : %s", c.name, err)
+			}
+		}
+
+		if err := worker.WriteRaw([]byte("3")); err != c.err {
+			t.Errorf("%s : got error %v, want %v", c.name, err, c.err)
+		}
+
+		m := worker.QueueMetrics()
+		c.metrics.Depth = c.depth
+		c.metrics.Capacity = 2
+		c.metrics.HighWater = 2
+		if m != c.metrics {
+			t.Errorf("%s : got metrics %+v, want %+v", c.name, m, c.metrics)
+		}
+
+		if sm := server.QueueMetrics(); sm.Dropped != m.Dropped || sm.Timeouts != m.Timeouts ||
+			sm.Disconnected != m.Disconnected {
+			t.Errorf("%s : server metrics %+v", c.name, sm)
+		}
+
+		if c.policy == QueuePolicyDropOldest {
+			if first := <-worker.sendQueue.ch; string(first) != "2" {
+				t.Errorf("%s : got %q at head", c.name, first)
+			}
+		}
+
+		if c.policy == QueuePolicyDisconnect {
+			if reason := worker.CloseReason(); reason == nil || reason.Code != CloseSlowConsumer {
+				t.Errorf("%s : closed with %v", c.name, reason)
+			}
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestQueueDiscard] */
+func TestQueueDiscard(t *testing.T) {
+	server := &SlaterServer{SendQueueSize: 8}
+	worker, client := newTestWorker(t, server)
+	defer client.conn.Close()
+
+	// Client reads nothing, the first one stuck in pipe
+	for i := 0; i < 4; i++ {
+		worker.WriteRaw([]byte{byte(i)})
+	}
+
+	if worker.sendPending() != 4 || server.drained([]*SlaterWorker{worker}) {
+		t.Fatalf("pending %d", worker.sendPending())
+	}
+
+	worker.Close(nil)
+	if worker.sendPending() != 0 || !server.drained([]*SlaterWorker{worker}) {
+		t.Errorf("pending %d after close", worker.sendPending())
+	}
+
+	waitClosed(t, worker)
+	deadline := time.Now().Add(testTimeout)
+	for atomic.LoadInt64(&worker.sendQueue.pending) != 0 && time.Now().Before(deadline) {
+		// Writer fails and exits
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := atomic.LoadInt64(&worker.sendQueue.pending); n != 0 || worker.QueueMetrics().Depth != 0 {
+		t.Errorf("pending %d, depth %d", n, worker.QueueMetrics().Depth)
+	}
+
+	if err := worker.WriteRaw([]byte{0}); err != ErrWorkerClosed {
+		t.Errorf("write after close : %v", err)
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
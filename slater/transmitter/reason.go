@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"fmt"
+)
+
+// CloseCode : Why worker terminated
+type CloseCode byte
+
+// Close codes
+const (
+	// CloseEOF : Connection closed by client
+	CloseEOF CloseCode = iota + 1
+	// CloseReadError : Socket read failed
+	CloseReadError
+	// CloseWriteError : Socket write failed
+	CloseWriteError
+	// CloseProtocolError : Malformed or oversized frame
+	CloseProtocolError
+	// CloseKick : Closed by application
+	CloseKick
+	// CloseTimeout : Idle, heartbeat or ACK timeout
+	CloseTimeout
+	// CloseShutdown : Server shutdown
+	CloseShutdown
+	// CloseSlowConsumer : Send queue overflowed
+	CloseSlowConsumer
+	// CloseInternal : Panic in worker goroutine or handler
+	CloseInternal
+	// CloseUnauthorized : Too many failed Online attempts
+	CloseUnauthorized
+)
+
+var closeCodeNames = map[CloseCode]string{
+	CloseEOF:           "eof",
+	CloseReadError:     "read error",
+	CloseWriteError:    "write error",
+	CloseProtocolError: "protocol error",
+	CloseKick:          "kick",
+	CloseTimeout:       "timeout",
+	CloseShutdown:      "shutdown",
+	CloseSlowConsumer:  "slow consumer",
+	CloseInternal:      "internal error",
+	CloseUnauthorized:  "unauthorized",
+}
+
+// String : Name of close code
+/* {{{ [String] */
+func (code CloseCode) String() string {
+	if name, ok := closeCodeNames[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown (%d)", code)
+}
+
+/* }}} */
+
+// CloseReason : Passed to OnCloseHandler
+type CloseReason struct {
+	Code CloseCode
+	Err  error
+}
+
+// Error : Implement error
+/* {{{ [Error] */
+func (reason *CloseReason) Error() string {
+	if reason.Err == nil {
+		return reason.Code.String()
+	}
+
+	return fmt.Sprintf("%s : %s", reason.Code.String(), reason.Err.Error())
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
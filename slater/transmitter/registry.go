@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"sync"
+)
+
+// Registry : Live workers of server, indexed by connection id, client
+// address and bound UID. Zero value is ready to use
+type Registry struct {
+	lock   sync.RWMutex
+	lastID uint64
+	byID   map[uint64]*SlaterWorker
+	byAddr map[string]*SlaterWorker
+	byUID  map[uint64]*SlaterWorker
+}
+
+// add : Register worker, assign connection id
+/* {{{ [add] */
+func (r *Registry) add(worker *SlaterWorker) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.byID == nil {
+		r.byID = make(map[uint64]*SlaterWorker)
+		r.byAddr = make(map[string]*SlaterWorker)
+		r.byUID = make(map[uint64]*SlaterWorker)
+	}
+
+	r.lastID++
+	worker.ID = r.lastID
+	r.byID[worker.ID] = worker
+	r.byAddr[worker.Addr] = worker
+	if uid := worker.UID(); uid > 0 {
+		r.byUID[uid] = worker
+	}
+
+	return worker.ID
+}
+
+/* }}} */
+
+// remove : Unregister worker
+/* {{{ [remove] */
+func (r *Registry) remove(worker *SlaterWorker) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.byID[worker.ID] != worker {
+		return
+	}
+
+	delete(r.byID, worker.ID)
+	if r.byAddr[worker.Addr] == worker {
+		delete(r.byAddr, worker.Addr)
+	}
+
+	if uid := worker.UID(); uid > 0 && r.byUID[uid] == worker {
+		delete(r.byUID, uid)
+	}
+}
+
+/* }}} */
+
+// bind : Bind UID to worker, 0 to unbind. If UID already bound to
+// another worker, the latest one wins and the former is returned to be
+// kicked by caller
+/* {{{ [bind] */
+func (r *Registry) bind(worker *SlaterWorker, uid uint64) *SlaterWorker {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if old := worker.UID(); old > 0 && r.byUID[old] == worker {
+		delete(r.byUID, old)
+	}
+
+	// Index kept by registry lock, field by state lock of worker
+	worker.stateLock.Lock()
+	worker.uid = uid
+	worker.stateLock.Unlock()
+	if uid == 0 || r.byID[worker.ID] != worker {
+		return nil
+	}
+
+	prev := r.byUID[uid]
+	r.byUID[uid] = worker
+	if prev == worker {
+		return nil
+	}
+
+	return prev
+}
+
+/* }}} */
+
+// Get : Worker by connection id
+/* {{{ [Get] */
+func (r *Registry) Get(id uint64) *SlaterWorker {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.byID[id]
+}
+
+/* }}} */
+
+// GetByAddr : Worker by client address
+/* {{{ [GetByAddr] */
+func (r *Registry) GetByAddr(addr string) *SlaterWorker {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.byAddr[addr]
+}
+
+/* }}} */
+
+// GetByUID : Worker by bound UID
+/* {{{ [GetByUID] */
+func (r *Registry) GetByUID(uid uint64) *SlaterWorker {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.byUID[uid]
+}
+
+/* }}} */
+
+// Range : Call fn on each worker until it returns false. Registry is
+// not locked while fn running
+/* {{{ [Range] */
+func (r *Registry) Range(fn func(worker *SlaterWorker) bool) {
+	for _, worker := range r.Workers() {
+		if !fn(worker) {
+			return
+		}
+	}
+}
+
+/* }}} */
+
+// Workers : Snapshot of all workers
+/* {{{ [Workers] */
+func (r *Registry) Workers() []*SlaterWorker {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ret := make([]*SlaterWorker, 0, len(r.byID))
+	for _, worker := range r.byID {
+		ret = append(ret, worker)
+	}
+
+	return ret
+}
+
+/* }}} */
+
+// Count : Amount of workers
+/* {{{ [Count] */
+func (r *Registry) Count() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.byID)
+}
+
+/* }}} */
+
+// CountOnline : Amount of workers with UID bound
+/* {{{ [CountOnline] */
+func (r *Registry) CountOnline() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.byUID)
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"fmt"
+	"testing"
+)
+
+/* {{{ [TestRegistry] */
+func TestRegistry(t *testing.T) {
+	var r Registry
+	workers := make([]*SlaterWorker, 3)
+	for i := range workers {
+		workers[i] = NewWorker(nil, fmt.Sprintf("10.0.0.%d:1000", i), nil)
+		if id := r.add(workers[i]); id != uint64(i+1) {
+			t.Fatalf("worker %d : got id %d", i, id)
+		}
+	}
+
+	steps := []struct {
+		name   string
+		fn     func()
+		count  int
+		online int
+	}{
+		{"added", func() {}, 3, 0},
+		{"bind", func() { r.bind(workers[0], 100) }, 3, 1},
+		{"bind another", func() { r.bind(workers[1], 200) }, 3, 2},
+		{"rebind same uid", func() {
+			if prev := r.bind(workers[2], 100); prev != workers[0] {
+				t.Errorf("former worker %v not returned", prev)
+			}
+		}, 3, 2},
+		{"former removed", func() { r.remove(workers[0]) }, 2, 2},
+		{"change uid", func() { r.bind(workers[1], 300) }, 2, 2},
+		{"unbind", func() { r.bind(workers[1], 0) }, 2, 1},
+		{"remove twice", func() { r.remove(workers[1]); r.remove(workers[1]) }, 1, 1},
+		{"bind removed", func() { r.bind(workers[1], 400) }, 1, 1},
+		{"remove bound", func() { r.remove(workers[2]) }, 0, 0},
+	}
+
+	for _, s := range steps {
+		s.fn()
+		if r.Count() != s.count || r.CountOnline() != s.online {
+			t.Errorf("%s : count %d online %d, want %d %d", s.name, r.Count(), r.CountOnline(), s.count, s.online)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestRegistryLookup] */
+func TestRegistryLookup(t *testing.T) {
+	var r Registry
+	a := NewWorker(nil, "a", nil)
+	b := NewWorker(nil, "b", nil)
+	r.add(a)
+	r.add(b)
+	r.bind(a, 1)
+	r.bind(b, 1)
+	r.bind(b, 2)
+
+	cases := []struct {
+		name string
+		got  *SlaterWorker
+		want *SlaterWorker
+	}{
+		{"id a", r.Get(a.ID), a},
+		{"id b", r.Get(b.ID), b},
+		{"id unknown", r.Get(99), nil},
+		{"addr a", r.GetByAddr("a"), a},
+		{"addr unknown", r.GetByAddr("c"), nil},
+		{"uid rebound then moved", r.GetByUID(1), nil},
+		{"uid b", r.GetByUID(2), b},
+	}
+
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("%s : got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	// Former owner removed later does not touch new binding
+	r.bind(a, 2)
+	r.remove(b)
+	if r.GetByUID(2) != a {
+		t.Error("binding of UID 2 lost")
+	}
+
+	n := 0
+	r.Range(func(worker *SlaterWorker) bool {
+		n++
+		return false
+	})
+
+	if n != 1 || len(r.Workers()) != 1 {
+		t.Errorf("range visited %d, %d workers", n, len(r.Workers()))
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestRegistryBindConcurrent] */
+func TestRegistryBindConcurrent(t *testing.T) {
+	var r Registry
+	worker := NewWorker(nil, "a", nil)
+	r.add(worker)
+
+	// UID read by other goroutines (watchdog, user code) while bound
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			worker.UID()
+		}
+	}()
+
+	for uid := uint64(1); uid <= 1000; uid++ {
+		r.bind(worker, uid)
+	}
+
+	<-done
+	if worker.UID() != 1000 || r.GetByUID(1000) != worker || r.GetByUID(999) != nil {
+		t.Errorf("UID %d not indexed", worker.UID())
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -33,11 +33,29 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/drnp/slater/slater/engine"
+	"github.com/drnp/slater/slater/runtime/utils"
 )
 
+// ErrServerShutdown : Connection closed by server shutdown
+var ErrServerShutdown = errors.New("Server shutdown")
+
+// shutdownCloseWait : Min wait of OnClose after connections closed by
+// shutdown
+const shutdownCloseWait = time.Second
+
+// runningServers : Servers accepting connections, targets of SendMessage
+var runningServers = struct {
+	sync.RWMutex
+	servers map[*SlaterServer]struct{}
+}{servers: make(map[*SlaterServer]struct{})}
+
 // HandlerFunc : Server handler function
 type HandlerFunc func(clientAddr string, request interface{}) (response interface{})
 
@@ -45,11 +63,15 @@ type HandlerFunc func(clientAddr string, request interface{}) (response interfac
 type OnConnectHandler func(worker *SlaterWorker) error
 
 // OnCloseHandler : Event on access close
-type OnCloseHandler func(worker *SlaterWorker) error
+type OnCloseHandler func(worker *SlaterWorker, reason *CloseReason) error
 
 // OnDataHandler : Event on access data
 type OnDataHandler func(worker *SlaterWorker) (int, error)
 
+// AuthenticateHandler : Validate credentials / token of Online message,
+// returns UID to bind with worker
+type AuthenticateHandler func(worker *SlaterWorker, msg *engine.Message) (uint64, error)
+
 // OnMessageHandler : Event on client message
 type OnMessageHandler func(worker *SlaterWorker, msg *engine.Message) error
 
@@ -61,13 +83,24 @@ type SlaterServer struct {
 	// Handler : Handler function for incoming request
 	Handler HandlerFunc
 
-	// nClients : Amount of clients
-	nClients int
-
 	// SendBufferSize : Size of send buffer
 	// Default value is 0
 	SendBufferSize int
 
+	// SendQueueSize : Max data (messages) queued for each worker
+	// DefaultSendQueueSize used if 0
+	SendQueueSize int
+
+	// SendQueuePolicy : Behavior when send queue full
+	SendQueuePolicy QueuePolicy
+
+	// SendQueueTimeout : Max wait of QueuePolicyBlock
+	// DefaultSendQueueTimeout used if 0
+	SendQueueTimeout time.Duration
+
+	// queueCounters : Send queue overflows of all workers
+	queueCounters queueCounters
+
 	// RecvBufferSize : Size of recieve buffer
 	// Default value is 0
 	RecvBufferSize int
@@ -78,14 +111,64 @@ type SlaterServer struct {
 	// stopChan : Send stop signal to server
 	stopChan chan struct{}
 
+	// loopChan : Closed when accept loop exited
+	loopChan chan struct{}
+
+	// stopLock : Protect stopChan
+	stopLock sync.Mutex
+
+	// Workers : Live workers
+	Workers Registry
+
+	// inflight : Amount of messages being handled
+	inflight int64
+
 	// Waiter : Symc waiter
 	Waiter *sync.WaitGroup
 
+	// RequireOnline : Drop messages from clients not passed Online handshake
+	RequireOnline bool
+
+	// AckTimeout : Downward message (sequenced, extended header only)
+	// resent if DownwardAck not received in time. 0 to disable
+	AckTimeout time.Duration
+
+	// AckRetries : Worker closed after retries of a downward message
+	AckRetries int
+
+	// IdleTimeout : Worker closed if nothing received in time. 0 to disable
+	IdleTimeout time.Duration
+
+	// HeartbeatTimeout : Worker closed if no Ping (or Pong answering
+	// server ping) received in time. 0 to disable
+	HeartbeatTimeout time.Duration
+
+	// PingInterval : Server sends Ping to client periodically. 0 to disable
+	PingInterval time.Duration
+
+	// Authenticate : Validate Online message
+	// DefaultAuthenticate (rejects all) used if nil
+	Authenticate AuthenticateHandler
+
+	// OnlineMaxFailures : Worker closed after failed Online attempts.
+	// 0 for unlimited
+	OnlineMaxFailures int
+
+	// Middlewares : Wrap OnMessage in order, the first one is the outermost
+	Middlewares []Middleware
+
+	// ProxyProtocol : Parse PROXY header from load balancers, stream
+	// listeners only. nil to disable
+	ProxyProtocol *ProxyProtocol
+
 	// Hooks
 	OnConnect OnConnectHandler
 	OnClose   OnCloseHandler
 	OnData    OnDataHandler
 	OnMessage OnMessageHandler
+
+	// onMessage : OnMessage wrapped by middlewares
+	onMessage OnMessageHandler
 }
 
 // serve : Go server
@@ -100,6 +183,8 @@ func (server *SlaterServer) serve() error {
 		return errors.New("Server handler cannot be nil")
 	}
 
+	server.stopLock.Lock()
+	defer server.stopLock.Unlock()
 	if server.stopChan != nil {
 		return errors.New("Server already running")
 	}
@@ -108,6 +193,15 @@ func (server *SlaterServer) serve() error {
 		server.Listener = &defaultListener{}
 	}
 
+	if server.ProxyProtocol != nil {
+		setter, ok := server.Listener.(proxySetter)
+		if !ok {
+			return errors.New("PROXY protocol not supported by listener")
+		}
+
+		setter.setProxy(server.ProxyProtocol)
+	}
+
 	err = server.Listener.Init(server.Addr)
 	if err != nil {
 		err = fmt.Errorf("Cannot listen to address [%s] : %s", server.Addr, err)
@@ -115,42 +209,71 @@ func (server *SlaterServer) serve() error {
 	}
 
 	server.stopChan = make(chan struct{})
+	server.loopChan = make(chan struct{})
+	if server.OnMessage != nil {
+		server.onMessage = Chain(server.OnMessage, server.Middlewares...)
+	}
+
+	stopChan := server.stopChan
+	runningServers.Lock()
+	runningServers.servers[server] = struct{}{}
+	runningServers.Unlock()
+
 	var conn io.ReadWriteCloser
 	var clientAddr string
 	var worker *SlaterWorker
+	logger := utils.NewLogger("SLATER SERVER: ")
+	var delay time.Duration
 
 	// Let's go
 	go func() {
 		for {
 			acceptChan := make(chan struct{})
 			go func() {
-				if conn, clientAddr, err = server.Listener.Accept(); err != nil {
-					// Accept error
-					fmt.Printf("Accept error\n")
-					panic(err)
-				}
-				close(acceptChan)
+				defer close(acceptChan)
+				defer func() {
+					if r := recover(); r != nil {
+						// Listener panic, treated as accept error
+						logger.Printf("Accept panic : %v\n%s", r, debug.Stack())
+						conn, err = nil, fmt.Errorf("Accept panic : %v", r)
+					}
+				}()
+
+				conn, clientAddr, err = server.Listener.Accept()
 			}()
 
 			select {
-			case <-server.stopChan:
+			case <-stopChan:
 				// Server close
 				server.Listener.Close()
-				server.Waiter.Done()
 				<-acceptChan
+				if err == nil {
+					conn.Close()
+				}
+
+				close(server.loopChan)
+				return
 			case <-acceptChan:
-				server.nClients++
 			}
 
 			if err != nil {
+				// Accept error, back off
+				logger.Printf("Accept error : %s\n", err.Error())
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay < time.Second {
+					delay *= 2
+				}
+
+				time.Sleep(delay)
 				continue
 			}
 
+			delay = 0
 			worker = NewWorker(server, clientAddr, conn)
+			server.Workers.add(worker)
 			go worker.Drive()
-			if server.OnConnect != nil {
-				server.OnConnect(worker)
-			}
+			server.connect(worker, logger)
 		}
 	}()
 
@@ -159,6 +282,24 @@ func (server *SlaterServer) serve() error {
 
 /* }}} */
 
+// connect : Call OnConnect of new worker, panic of handler closes
+// the connection only
+/* {{{ [connect] */
+func (server *SlaterServer) connect(worker *SlaterWorker, logger *log.Logger) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Printf("Client %s OnConnect panic : %v\n%s", worker.Addr, r, debug.Stack())
+			worker.closeWith(CloseInternal, fmt.Errorf("OnConnect panic : %v", r))
+		}
+	}()
+
+	if server.OnConnect != nil {
+		server.OnConnect(worker)
+	}
+}
+
+/* }}} */
+
 // Start : Network server startup
 /* {{{ [Start] Start server */
 func (server *SlaterServer) Start() error {
@@ -182,19 +323,93 @@ func (server *SlaterServer) Start() error {
 
 /* }}} */
 
-// Stop : Stop network server
+// Stop : Stop network server, all connections closed immediately
 /* {{{ [Stop] Stop server */
 func (server *SlaterServer) Stop() error {
+	return server.Shutdown(0)
+}
+
+/* }}} */
+
+// Shutdown : Stop accepting, send Offline to all clients and wait for
+// in-flight handlers and send buffers, then close all connections after
+// timeout at most. Returns (and Waiter done) after OnClose of all workers
+// called
+/* {{{ [Shutdown] Graceful stop */
+func (server *SlaterServer) Shutdown(timeout time.Duration) error {
 	if server == nil {
 		return errors.New("Invalid server object")
 	}
 
-	if server.stopChan == nil {
+	server.stopLock.Lock()
+	stopChan := server.stopChan
+	server.stopChan = nil
+	server.stopLock.Unlock()
+	if stopChan == nil {
 		return errors.New("Server not running")
 	}
 
-	close(server.stopChan)
-	server.stopChan = nil
+	// Stop accepting
+	runningServers.Lock()
+	delete(runningServers.servers, server)
+	runningServers.Unlock()
+
+	close(stopChan)
+	<-server.loopChan
+
+	workers := server.Workers.Workers()
+	deadline := time.Now().Add(timeout)
+	if timeout > 0 {
+		// Drain
+		var notified sync.WaitGroup
+		notifiedChan := make(chan struct{})
+		for _, worker := range workers {
+			notified.Add(1)
+			go func(worker *SlaterWorker) {
+				defer notified.Done()
+				offline := engine.NewMessage(nil)
+				offline.Type = engine.MsgTypeOffline
+				worker.WriteMessage(offline)
+			}(worker)
+		}
+
+		go func() {
+			notified.Wait()
+			close(notifiedChan)
+		}()
+
+		select {
+		case <-notifiedChan:
+		case <-time.After(timeout):
+		}
+
+		for time.Now().Before(deadline) && !server.drained(workers) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, worker := range workers {
+		worker.closeWith(CloseShutdown, ErrServerShutdown)
+	}
+
+	// Readers finish (OnClose) asynchronously
+	wait := time.Until(deadline)
+	if wait < shutdownCloseWait {
+		wait = shutdownCloseWait
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+loop:
+	for _, worker := range workers {
+		select {
+		case <-worker.closeChan:
+		case <-timer.C:
+			utils.NewLogger("SLATER SERVER: ").Printf("%d workers not finished on shutdown\n", server.Workers.Count())
+			break loop
+		}
+	}
+
 	if server.Waiter != nil {
 		server.Waiter.Done()
 	}
@@ -204,6 +419,86 @@ func (server *SlaterServer) Stop() error {
 
 /* }}} */
 
+// SendMessage : Send downward message to workers bound to UIDs listed in
+// message body, broadcast to all (online if RequireOnline) workers if list
+// empty. UIDs not bound to any worker on this server returned as offline
+/* {{{ [SendMessage] */
+func (server *SlaterServer) SendMessage(msg *engine.Message) ([]int64, error) {
+	if server == nil {
+		return nil, errors.New("Invalid server object")
+	}
+
+	if msg == nil {
+		return nil, errors.New("Invalid message object")
+	}
+
+	return server.send(msg, msg.Body.UID), nil
+}
+
+/* }}} */
+
+// send : Send downward message to workers bound to uids, broadcast if
+// uids empty. Never waits for full send queue of slow workers. Returns
+// offline UIDs
+/* {{{ [send] */
+func (server *SlaterServer) send(msg *engine.Message, uids []int64) []int64 {
+	m := *msg
+	m.Type = engine.MsgTypeDownward
+	if len(uids) == 0 {
+		// Broadcast
+		server.Workers.Range(func(worker *SlaterWorker) bool {
+			if !server.RequireOnline || worker.IsOnline() {
+				worker.writeMessage(&m, false)
+			}
+
+			return true
+		})
+
+		return nil
+	}
+
+	var offline []int64
+	sent := make(map[int64]bool, len(uids))
+	for _, uid := range uids {
+		if _, ok := sent[uid]; ok {
+			// Duplicated
+			continue
+		}
+
+		var worker *SlaterWorker
+		if uid > 0 {
+			worker = server.Workers.GetByUID(uint64(uid))
+		}
+
+		sent[uid] = worker != nil && worker.writeMessage(&m, false) == nil
+		if !sent[uid] {
+			offline = append(offline, uid)
+		}
+	}
+
+	return offline
+}
+
+/* }}} */
+
+// drained : No message being handled and all send buffers flushed
+/* {{{ [drained] */
+func (server *SlaterServer) drained(workers []*SlaterWorker) bool {
+	if atomic.LoadInt64(&server.inflight) > 0 {
+		return false
+	}
+
+	for _, worker := range workers {
+		if worker.sendPending() > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* }}} */
+
 /*
  * Local variables:
  * tab-width: 4
@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+)
+
+// chanListener : Listener accepting connections pushed into channel,
+// panics on nil one
+type chanListener struct {
+	conns     chan net.Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanListener() *chanListener {
+	return &chanListener{
+		conns:     make(chan net.Conn),
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (cl *chanListener) Init(addr string) error {
+	return nil
+}
+
+func (cl *chanListener) Accept() (io.ReadWriteCloser, string, error) {
+	select {
+	case conn := <-cl.conns:
+		if conn == nil {
+			panic("nil connection")
+		}
+
+		return conn, conn.RemoteAddr().String(), nil
+	case <-cl.closeChan:
+		return nil, "", errors.New("listener closed")
+	}
+}
+
+func (cl *chanListener) Close() error {
+	cl.closeOnce.Do(func() { close(cl.closeChan) })
+
+	return nil
+}
+
+func (cl *chanListener) ListenAddr() net.Addr {
+	return nil
+}
+
+// startTestServer : Start server on listener
+/* {{{ [startTestServer] */
+func startTestServer(t *testing.T, server *SlaterServer, listener SlaterListener) {
+	server.Handler = AccessRequest
+	server.Listener = listener
+	server.Waiter = &sync.WaitGroup{}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestAcceptPanic] */
+func TestAcceptPanic(t *testing.T) {
+	connected := make(chan *SlaterWorker, 1)
+	server := &SlaterServer{
+		OnConnect: func(worker *SlaterWorker) error {
+			connected <- worker
+			return nil
+		},
+	}
+
+	listener := newChanListener()
+	startTestServer(t, server, listener)
+	defer server.Stop()
+
+	// Accept loop survives panic of listener
+	listener.conns <- nil
+
+	s, c := net.Pipe()
+	defer c.Close()
+	select {
+	case listener.conns <- s:
+	case <-time.After(testTimeout):
+		t.Fatal("accept loop exited")
+	}
+
+	select {
+	case worker := <-connected:
+		if server.Workers.Get(worker.ID) != worker {
+			t.Error("worker not registered")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("worker not connected")
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestSendSlowWorker] */
+func TestSendSlowWorker(t *testing.T) {
+	server := &SlaterServer{
+		Authenticate:     trustAuthenticate,
+		SendQueueSize:    1,
+		SendQueuePolicy:  QueuePolicyBlock,
+		SendQueueTimeout: time.Second,
+	}
+
+	slow, slowClient := newTestWorker(t, server)
+	fast, fastClient := newTestWorker(t, server)
+	slowClient.online(1)
+	fastClient.online(2)
+
+	// Slow client reads nothing : first frame stuck in pipe, second one
+	// queued, the third one in backlog
+	payloads := []string{"1", "2", "3"}
+	start := time.Now()
+	for _, payload := range payloads {
+		msg := downward(payload)
+		msg.Body.UID = []int64{1, 2}
+		if offline, _ := server.SendMessage(msg); len(offline) > 0 {
+			t.Errorf("payload %s : offline %v", payload, offline)
+		}
+
+		if m := fastClient.recv(); string(m.Body.Payload) != payload {
+			t.Errorf("fast client got %q, want %q", m.Body.Payload, payload)
+		}
+
+		if payload == "1" {
+			// Let writer take it and block on pipe
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed >= server.SendQueueTimeout/2 {
+		t.Errorf("send stalled by slow worker for %s", elapsed)
+	}
+
+	// Backlog full
+	msg := downward("4")
+	msg.Body.UID = []int64{1}
+	if offline, _ := server.SendMessage(msg); len(offline) != 1 {
+		t.Errorf("backlog overflow not reported, offline %v", offline)
+	}
+
+	if slow.QueueMetrics().Timeouts != 1 {
+		t.Errorf("timeouts %d", slow.QueueMetrics().Timeouts)
+	}
+
+	// Delivered in order once slow client reads
+	for _, payload := range payloads {
+		if m := slowClient.recv(); string(m.Body.Payload) != payload {
+			t.Errorf("slow client got %q, want %q", m.Body.Payload, payload)
+		}
+	}
+
+	slowClient.conn.Close()
+	fastClient.conn.Close()
+	waitClosed(t, slow)
+	waitClosed(t, fast)
+}
+
+/* }}} */
+
+/* {{{ [TestShutdown] */
+func TestShutdown(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		reading bool
+		forced  bool
+	}{
+		{"drain", testTimeout, true, false},
+		{"deadline", 300 * time.Millisecond, false, true},
+		{"stop", 0, true, false},
+	}
+
+	for _, c := range cases {
+		var (
+			lock    sync.Mutex
+			reasons []CloseCode
+		)
+
+		connected := make(chan *SlaterWorker, 2)
+		server := &SlaterServer{
+			OnConnect: func(worker *SlaterWorker) error {
+				connected <- worker
+				return nil
+			},
+			OnClose: func(worker *SlaterWorker, reason *CloseReason) error {
+				// Games persist session state here
+				time.Sleep(100 * time.Millisecond)
+				lock.Lock()
+				reasons = append(reasons, reason.Code)
+				lock.Unlock()
+
+				return nil
+			},
+		}
+
+		listener := newChanListener()
+		startTestServer(t, server, listener)
+
+		// The second client reads nothing in case not reading
+		received := make(chan []byte, 2)
+		for i := 0; i < 2; i++ {
+			s, conn := net.Pipe()
+			defer conn.Close()
+			listener.conns <- s
+			worker := <-connected
+			msg := downward("bye")
+			msg.SerializeMode = engine.MsgSerializeRaw
+			worker.WriteMessage(msg)
+			if i == 1 && !c.reading {
+				continue
+			}
+
+			client := &testClient{t: t, conn: conn, buffer: bytes.NewBuffer(nil)}
+			go func() {
+				var types []byte
+				for m := client.recv(); m != nil; m = client.recv() {
+					types = append(types, m.Type)
+				}
+
+				received <- types
+			}()
+		}
+
+		start := time.Now()
+		server.Shutdown(c.timeout)
+		elapsed := time.Since(start)
+		if c.forced && elapsed < c.timeout {
+			t.Errorf("%s : closed after %s, before deadline", c.name, elapsed)
+		} else if !c.forced && c.timeout > 0 && elapsed >= c.timeout {
+			t.Errorf("%s : drain not finished in %s", c.name, elapsed)
+		}
+
+		lock.Lock()
+		if len(reasons) != 2 {
+			t.Errorf("%s : OnClose called %d times before shutdown returned", c.name, len(reasons))
+		}
+
+		for _, code := range reasons {
+			if code != CloseShutdown {
+				t.Errorf("%s : closed with %s", c.name, code)
+			}
+		}
+		lock.Unlock()
+
+		// Downward message flushed before Offline
+		if c.timeout > 0 {
+			want := []byte{engine.MsgTypeDownward, engine.MsgTypeOffline}
+			if types := <-received; !bytes.Equal(types, want) {
+				t.Errorf("%s : client got types %v, want %v", c.name, types, want)
+			}
+		}
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
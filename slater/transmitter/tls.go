@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// tlsListener : TLSServer listener
+/* {{{ [tlsListener] */
+type tlsListener struct {
+	proxyOption
+	Config *tls.Config
+	L      net.Listener
+}
+
+func (tl *tlsListener) Init(addr string) (err error) {
+	if tl.Config == nil {
+		return errors.New("TLS config cannot be nil")
+	}
+
+	fmt.Printf("Listen on addr (TLS) : %s\n", addr)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	// PROXY header precedes TLS handshake
+	tl.L = tls.NewListener(tl.wrap(l), tl.Config)
+
+	return
+}
+
+// Accept : Handshake deferred to the first read / write of worker, so
+// slow clients never block accept loop
+func (tl *tlsListener) Accept() (conn io.ReadWriteCloser, clientAddr string, err error) {
+	c, err := tl.L.Accept()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return c, c.RemoteAddr().String(), nil
+}
+
+func (tl *tlsListener) Close() error {
+	return tl.L.Close()
+}
+
+func (tl *tlsListener) ListenAddr() net.Addr {
+	if tl.L != nil {
+		return tl.L.Addr()
+	}
+
+	return nil
+}
+
+/* }}} */
+
+// LoadTLSConfig : Create server TLS config from PEM files. Client
+// certificates required and verified against clientCAFile if given
+/* {{{ [LoadTLSConfig] */
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Load TLS certificate failed : %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Load client CA failed : %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No valid certificate in client CA file")
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+/* }}} */
+
+// NewTLSServer : Create a new TLS server
+/* {{{ [NewTLSServer] Create TLS server */
+func NewTLSServer(addr string, handler HandlerFunc, config *tls.Config) *SlaterServer {
+	return &SlaterServer{
+		Addr:    addr,
+		Handler: handler,
+		Listener: &tlsListener{
+			Config: config,
+		},
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+)
+
+// testCert : Certificate and key generated for tests
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	tls      tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+// newTestCert : Create certificate signed by parent, self-signed CA if
+// parent is nil. PEM files written into dir
+/* {{{ [newTestCert] */
+func newTestCert(t *testing.T, dir string, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := &testCert{
+		key:      key,
+		certFile: filepath.Join(dir, name+".pem"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+
+	ret.cert, _ = x509.ParseCertificate(der)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = os.WriteFile(ret.certFile, certPEM, 0600); err == nil {
+		err = os.WriteFile(ret.keyFile, keyPEM, 0600)
+	}
+
+	if err == nil {
+		ret.tls, err = tls.X509KeyPair(certPEM, keyPEM)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ret
+}
+
+/* }}} */
+
+// pingPong : Send legacy Ping over conn, true if Pong answered
+/* {{{ [pingPong] */
+func pingPong(conn net.Conn) bool {
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := conn.Write([]byte{engine.MsgTypePing << 4, 0, 0, 0, 0}); err != nil {
+		return false
+	}
+
+	pong := make([]byte, 5)
+	if _, err := io.ReadFull(conn, pong); err != nil {
+		return false
+	}
+
+	return pong[0]>>4 == engine.MsgTypePong
+}
+
+/* }}} */
+
+/* {{{ [TestLoadTLSConfig] */
+func TestLoadTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca)
+	garbage := filepath.Join(dir, "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0600)
+
+	cases := []struct {
+		name     string
+		cert     string
+		key      string
+		clientCA string
+		auth     tls.ClientAuthType
+		fail     bool
+	}{
+		{"server only", server.certFile, server.keyFile, "", tls.NoClientCert, false},
+		{"client CA", server.certFile, server.keyFile, ca.certFile, tls.RequireAndVerifyClientCert, false},
+		{"missing cert", filepath.Join(dir, "none.pem"), server.keyFile, "", 0, true},
+		{"mismatched key", server.certFile, ca.keyFile, "", 0, true},
+		{"missing client CA", server.certFile, server.keyFile, filepath.Join(dir, "none.pem"), 0, true},
+		{"invalid client CA", server.certFile, server.keyFile, garbage, 0, true},
+	}
+
+	for _, c := range cases {
+		cfg, err := LoadTLSConfig(c.cert, c.key, c.clientCA)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s : error expected", c.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s : %s", c.name, err)
+			continue
+		}
+
+		if cfg.ClientAuth != c.auth || cfg.MinVersion != tls.VersionTLS12 {
+			t.Errorf("%s : client auth %d, min version %x", c.name, cfg.ClientAuth, cfg.MinVersion)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestTLSServer] */
+func TestTLSServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	serverCert := newTestCert(t, dir, "server", ca)
+	clientCert := newTestCert(t, dir, "client", ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	cases := []struct {
+		name       string
+		clientCA   string
+		clientCert *testCert
+		ok         bool
+	}{
+		{"server auth", "", nil, true},
+		{"mutual auth", ca.certFile, clientCert, true},
+		{"client cert missing", ca.certFile, nil, false},
+	}
+
+	for _, c := range cases {
+		cfg, err := LoadTLSConfig(serverCert.certFile, serverCert.keyFile, c.clientCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := NewTLSServer("127.0.0.1:0", AccessRequest, cfg)
+		startTestServer(t, server, server.Listener)
+
+		clientCfg := &tls.Config{RootCAs: roots}
+		if c.clientCert != nil {
+			clientCfg.Certificates = []tls.Certificate{c.clientCert.tls}
+		}
+
+		conn, err := tls.Dial("tcp", server.Listener.ListenAddr().String(), clientCfg)
+		if err != nil {
+			t.Fatalf("%s : %s", c.name, err)
+		}
+
+		if ok := pingPong(conn); ok != c.ok {
+			t.Errorf("%s : ping answered %v", c.name, ok)
+		}
+
+		conn.Close()
+		server.Stop()
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -36,6 +36,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/drnp/slater/slater/engine"
 	"github.com/drnp/slater/slater/runtime/utils"
@@ -61,15 +62,27 @@ type SlaterListener interface {
 
 /* }}} */
 
+// datagramConn : Connection carrying unreliable datagrams besides stream
+type datagramConn interface {
+	// WriteDatagram : Send data (complete frames) in one datagram,
+	// errDatagramTooLarge if exceeds MTU
+	WriteDatagram(data []byte) error
+
+	// OnDatagram : Set handler of datagrams received
+	OnDatagram(handler func(data []byte))
+}
+
 // defaultListener : TCPServer listener
 /* {{{ [defaultListener] */
 type defaultListener struct {
+	proxyOption
 	L net.Listener
 }
 
 func (dl *defaultListener) Init(addr string) (err error) {
 	fmt.Printf("Listen on addr : %s\n", addr)
 	dl.L, err = net.Listen("tcp", addr)
+	dl.L = dl.wrap(dl.L)
 
 	return
 }
@@ -97,11 +110,55 @@ func (dl *defaultListener) ListenAddr() net.Addr {
 
 /* }}} */
 
-// netListener : General listener
+// netListener : General listener, net.Listener created by F on Init
 /* {{{ [netListener] */
 type netListener struct {
+	proxyOption
 	F func(addr string) (net.Listener, error)
 	L net.Listener
+
+	// nAccepted : Make client address unique if remote has no name
+	nAccepted uint64
+}
+
+func (nl *netListener) Init(addr string) (err error) {
+	if nl.F == nil {
+		return errors.New("Listener factory cannot be nil")
+	}
+
+	fmt.Printf("Listen on addr : %s\n", addr)
+	nl.L, err = nl.F(addr)
+	nl.L = nl.wrap(nl.L)
+
+	return
+}
+
+func (nl *netListener) Accept() (conn io.ReadWriteCloser, clientAddr string, err error) {
+	c, err := nl.L.Accept()
+	if err != nil {
+		return nil, "", err
+	}
+
+	nl.nAccepted++
+	clientAddr = c.RemoteAddr().String()
+	if clientAddr == "" || clientAddr == "@" {
+		// Unnamed UNIX socket peer
+		clientAddr = fmt.Sprintf("%s#%d", nl.L.Addr().String(), nl.nAccepted)
+	}
+
+	return c, clientAddr, nil
+}
+
+func (nl *netListener) Close() error {
+	return nl.L.Close()
+}
+
+func (nl *netListener) ListenAddr() net.Addr {
+	if nl.L != nil {
+		return nl.L.Addr()
+	}
+
+	return nil
 }
 
 /* }}} */
@@ -121,25 +178,58 @@ func NewTCPServer(addr string, handler HandlerFunc) *SlaterServer {
 // NewWorker : Create a new worker
 /* {{{ [NewWorker] Create worker */
 func NewWorker(server *SlaterServer, addr string, conn io.ReadWriteCloser) *SlaterWorker {
+	var queue *sendQueue
+	if server != nil {
+		queue = newSendQueue(server.SendQueueSize, server.SendQueuePolicy, server.SendQueueTimeout)
+	} else {
+		queue = newSendQueue(0, QueuePolicyBlock, 0)
+	}
+
+	now := time.Now().UnixNano()
+
 	return &SlaterWorker{
-		Addr:       addr,
-		UID:        0,
-		conn:       conn,
-		recvBuffer: bytes.NewBuffer(nil),
-		sendBuffer: bytes.NewBuffer(nil),
-		recvChan:   make(chan struct{}),
-		sendChan:   make(chan int),
-		closeChan:  make(chan struct{}),
-		server:     server,
+		Addr:          addr,
+		conn:          conn,
+		recvBuffer:    bytes.NewBuffer(nil),
+		sendQueue:     queue,
+		recvChan:      make(chan struct{}),
+		closeChan:     make(chan struct{}),
+		server:        server,
+		pending:       make(map[uint32]*pendingMessage),
+		lastRecv:      now,
+		lastHeartbeat: now,
 	}
 }
 
 /* }}} */
 
-// SendMessage : Send command (message) to remote
+// SendMessage : Send command (message) to remote. Delivered to workers
+// bound to UIDs listed in message body on all running servers, broadcast
+// if list empty. Returns UIDs not online on any server
 /* {{{ [SendCommand] Send message */
-func SendMessage(msg *engine.Message) {
+func SendMessage(msg *engine.Message) ([]int64, error) {
+	if msg == nil {
+		return nil, errors.New("Invalid message object")
+	}
 
+	runningServers.RLock()
+	servers := make([]*SlaterServer, 0, len(runningServers.servers))
+	for server := range runningServers.servers {
+		servers = append(servers, server)
+	}
+	runningServers.RUnlock()
+
+	offline := msg.Body.UID
+	for _, server := range servers {
+		if len(msg.Body.UID) == 0 {
+			// Broadcast
+			server.send(msg, nil)
+		} else if len(offline) > 0 {
+			offline = server.send(msg, offline)
+		}
+	}
+
+	return offline, nil
 }
 
 /* }}} */
@@ -157,16 +247,30 @@ func DefaultOnConnect(worker *SlaterWorker) error {
 }
 
 // DefaultOnClose : Default behavior
-func DefaultOnClose(worker *SlaterWorker) error {
+func DefaultOnClose(worker *SlaterWorker, reason *CloseReason) error {
 	if worker == nil {
 		return errors.New("Invalid worker object")
 	}
 
-	fmt.Printf("Client %s disconnected\n", worker.Addr)
+	if reason != nil {
+		fmt.Printf("Client %s disconnected : %s\n", worker.Addr, reason.Error())
+	} else {
+		fmt.Printf("Client %s disconnected\n", worker.Addr)
+	}
 
 	return nil
 }
 
+// ErrNoAuthenticator : Online rejected by DefaultAuthenticate
+var ErrNoAuthenticator = errors.New("No authenticator configured")
+
+// DefaultAuthenticate : Default behavior, reject every Online message.
+// UID claimed by client cannot be trusted, games must supply their own
+// token validation
+func DefaultAuthenticate(worker *SlaterWorker, msg *engine.Message) (uint64, error) {
+	return 0, ErrNoAuthenticator
+}
+
 // DefaultOnData : Default behavior
 func DefaultOnData(worker *SlaterWorker) (int, error) {
 	if worker == nil {
@@ -188,19 +292,14 @@ func DefaultOnnMessage(worker *SlaterWorker, msg *engine.Message) error {
 
 	utils.DebugMessage(msg)
 	if msg.Body.Payload != nil {
-		cmd, _ := engine.CmdDecode(msg.Body.Payload, msg.SerializeMode)
-		if cmd != nil {
-			utils.DebugCommand(cmd)
+		resp, err := engine.Command(msg)
+		if err != nil {
+			return err
 		}
 
-		downmsg := engine.NewMessage(nil)
-		downmsg.Type = engine.MsgTypeDownward
-		//downmsg.SerializeMode = msg.SerializeMode
-		downmsg.Body.UID = []int64{8051}
-		downmsg.Body.App = "testApp"
-		downmsg.Body.Payload = msg.Body.Payload
-
-		worker.WriteMessage(downmsg)
+		if resp != nil {
+			return worker.WriteMessage(resp)
+		}
 	} else {
 		if engine.MsgTypePing == msg.Type {
 			downmsg := engine.NewMessage(nil)
@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDPOptions : ARQ parameters of UDP sessions
+type UDPOptions struct {
+	// NoDelay : Lower minimum RTO and slower RTO backoff
+	NoDelay bool
+
+	// Interval : Flush (ACK and retransmit check) interval
+	Interval time.Duration
+
+	// FastResend : Retransmit a segment skipped by this many ACKs, 0 to
+	// disable fast retransmit
+	FastResend int
+
+	// NoCongestion : Send window not limited by congestion window
+	NoCongestion bool
+
+	// SndWnd / RcvWnd : Window size in segments
+	SndWnd int
+	RcvWnd int
+
+	// MTU : Max datagram size
+	MTU int
+
+	// MaxSessions : Max live sessions, new conversations dropped beyond
+	MaxSessions int
+
+	// Timeout : Session closed if nothing received from remote for this
+	// long, independent of worker timeouts
+	Timeout time.Duration
+}
+
+// DefaultUDPOptions : Turbo mode for real-time games
+var DefaultUDPOptions = UDPOptions{
+	NoDelay:      true,
+	Interval:     10 * time.Millisecond,
+	FastResend:   2,
+	NoCongestion: true,
+	SndWnd:       128,
+	RcvWnd:       128,
+	MTU:          1400,
+	MaxSessions:  10000,
+	Timeout:      30 * time.Second,
+}
+
+// normalize : Defaults for zero values
+/* {{{ [normalize] */
+func (opts UDPOptions) normalize() UDPOptions {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultUDPOptions.Interval
+	}
+
+	if opts.SndWnd <= 0 {
+		opts.SndWnd = DefaultUDPOptions.SndWnd
+	}
+
+	if opts.RcvWnd <= 0 {
+		opts.RcvWnd = DefaultUDPOptions.RcvWnd
+	} else if opts.RcvWnd > 0xFFFF {
+		opts.RcvWnd = 0xFFFF
+	}
+
+	if opts.MTU <= arqHeaderLength {
+		opts.MTU = DefaultUDPOptions.MTU
+	}
+
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = DefaultUDPOptions.MaxSessions
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultUDPOptions.Timeout
+	}
+
+	return opts
+}
+
+/* }}} */
+
+// udpBacklog : Sessions waiting for Accept
+const udpBacklog = 128
+
+// udpListener : UDPServer listener, sessions identified by remote
+// address and conversation id (the first 4 bytes of each datagram)
+/* {{{ [udpListener] */
+type udpListener struct {
+	Options UDPOptions
+	conn    net.PacketConn
+
+	lock       sync.Mutex
+	sessions   map[string]*arqSession
+	acceptChan chan *arqSession
+	closeChan  chan struct{}
+	closed     bool
+}
+
+func (ul *udpListener) Init(addr string) (err error) {
+	fmt.Printf("Listen on addr (UDP) : %s\n", addr)
+	ul.conn, err = net.ListenPacket("udp", addr)
+	if err != nil {
+		return
+	}
+
+	ul.Options = ul.Options.normalize()
+	ul.sessions = make(map[string]*arqSession)
+	ul.acceptChan = make(chan *arqSession, udpBacklog)
+	ul.closeChan = make(chan struct{})
+	go ul.readLoop()
+
+	return
+}
+
+// readLoop : Dispatch datagrams to sessions, create session on the
+// first push segment (sn 0) of unknown conversation if MaxSessions not
+// reached
+func (ul *udpListener) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := ul.conn.ReadFrom(buf)
+		if err != nil {
+			// Socket closed
+			return
+		}
+
+		if n < arqHeaderLength {
+			continue
+		}
+
+		conv := binary.BigEndian.Uint32(buf[0:4])
+		key := fmt.Sprintf("%s/%d", addr.String(), conv)
+		ul.lock.Lock()
+		s := ul.sessions[key]
+		if s == nil {
+			if ul.closed || arqCmdPush != buf[4] || 0 != binary.BigEndian.Uint32(buf[11:15]) ||
+				len(ul.sessions) >= ul.Options.MaxSessions {
+				ul.lock.Unlock()
+				continue
+			}
+
+			s = newARQSession(conv, ul.Options, func(data []byte) error {
+				_, err := ul.conn.WriteTo(data, addr)
+				return err
+			}, func() {
+				ul.remove(key)
+			})
+			s.addr = key
+
+			select {
+			case ul.acceptChan <- s:
+				ul.sessions[key] = s
+				go s.run()
+			default:
+				// Backlog full, client retransmits later
+				ul.lock.Unlock()
+				continue
+			}
+		}
+
+		ul.lock.Unlock()
+		s.input(buf[:n])
+	}
+}
+
+// remove : Session finalized, socket closed after listener closed and
+// the last session gone
+func (ul *udpListener) remove(key string) {
+	ul.lock.Lock()
+	defer ul.lock.Unlock()
+
+	delete(ul.sessions, key)
+	if ul.closed && len(ul.sessions) == 0 {
+		ul.conn.Close()
+	}
+}
+
+func (ul *udpListener) Accept() (conn io.ReadWriteCloser, clientAddr string, err error) {
+	select {
+	case s := <-ul.acceptChan:
+		return s, s.addr, nil
+	case <-ul.closeChan:
+		return nil, "", errListenerClosed
+	}
+}
+
+// Close : Stop accepting. Socket shared by sessions, kept open until all
+// of them closed
+func (ul *udpListener) Close() error {
+	ul.lock.Lock()
+	if ul.closed {
+		ul.lock.Unlock()
+		return nil
+	}
+
+	ul.closed = true
+	close(ul.closeChan)
+	ul.lock.Unlock()
+
+	// Never accepted
+	for {
+		select {
+		case s := <-ul.acceptChan:
+			s.Close()
+		default:
+			ul.lock.Lock()
+			if len(ul.sessions) == 0 {
+				ul.conn.Close()
+			}
+			ul.lock.Unlock()
+
+			return nil
+		}
+	}
+}
+
+func (ul *udpListener) ListenAddr() net.Addr {
+	if ul.conn != nil {
+		return ul.conn.LocalAddr()
+	}
+
+	return nil
+}
+
+/* }}} */
+
+// NewUDPServer : Create a new UDP server, each conversation of client is
+// a reliable ordered stream carrying slater frames
+/* {{{ [NewUDPServer] Create UDP server */
+func NewUDPServer(addr string, handler HandlerFunc, opts UDPOptions) *SlaterServer {
+	return &SlaterServer{
+		Addr:    addr,
+		Handler: handler,
+		Listener: &udpListener{
+			Options: opts,
+		},
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,408 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+)
+
+// udpClient : ARQ session of client over UDP socket, datagrams (both
+// directions) dropped if drop returns true
+/* {{{ [udpClient] */
+func udpClient(t *testing.T, addr string, conv uint32, drop func() bool) (*arqSession, *net.UDPConn) {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.DialUDP("udp", nil, ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if drop == nil {
+		drop = func() bool { return false }
+	}
+
+	s := newARQSession(conv, DefaultUDPOptions, func(data []byte) error {
+		if drop() {
+			return nil
+		}
+
+		_, err := c.Write(data)
+		return err
+	}, nil)
+
+	go s.run()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+
+			if !drop() {
+				s.input(buf[:n])
+			}
+		}
+	}()
+
+	return s, c
+}
+
+/* }}} */
+
+// readFrames : Read n frames from stream
+/* {{{ [readFrames] */
+func readFrames(t *testing.T, r interface{ Read([]byte) (int, error) }, n int) []*engine.Message {
+	var ret []*engine.Message
+	buf := bytes.NewBuffer(nil)
+	msg := engine.NewMessage(buf)
+	p := make([]byte, 4096)
+	for len(ret) < n {
+		ok, err := msg.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok {
+			ret = append(ret, msg)
+			msg = engine.NewMessage(buf)
+			continue
+		}
+
+		k, err := r.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf.Write(p[:k])
+	}
+
+	return ret
+}
+
+/* }}} */
+
+/* {{{ [TestUDPServer] */
+func TestUDPServer(t *testing.T) {
+	closed := make(chan *CloseReason, 1)
+	server := NewUDPServer("127.0.0.1:0", AccessRequest, DefaultUDPOptions)
+	server.OnClose = func(worker *SlaterWorker, reason *CloseReason) error {
+		closed <- reason
+		return nil
+	}
+
+	startTestServer(t, server, server.Listener)
+	defer server.Stop()
+
+	// 20% loss until closing, the close segment is never retransmitted
+	var (
+		lock  sync.Mutex
+		lossy = true
+	)
+
+	r := rand.New(rand.NewSource(1))
+	drop := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return lossy && r.Float64() < 0.2
+	}
+
+	client, conn := udpClient(t, server.Listener.ListenAddr().String(), 7, drop)
+	defer conn.Close()
+
+	const n = 300
+	var out []byte
+	for i := 0; i < n; i++ {
+		out = append(out, engine.MsgTypePing<<4, 0, 0, 0, 0)
+	}
+
+	client.Write(out)
+	for _, msg := range readFrames(t, client, n) {
+		if msg.Type != engine.MsgTypePong {
+			t.Fatalf("got type %d, want pong", msg.Type)
+		}
+	}
+
+	// Large downward message split into segments
+	payload := make([]byte, 200000)
+	rand.Read(payload)
+	msg := engine.NewMessage(nil)
+	msg.Type = engine.MsgTypeDownward
+	msg.SerializeMode = engine.MsgSerializeRaw
+	msg.Body.Payload = payload
+	server.Workers.Workers()[0].WriteMessage(msg)
+	if ret := readFrames(t, client, 1)[0]; !bytes.Equal(ret.Body.Payload, payload) {
+		t.Error("payload mismatch")
+	}
+
+	lock.Lock()
+	lossy = false
+	lock.Unlock()
+
+	client.Close()
+	select {
+	case reason := <-closed:
+		if reason.Code != CloseEOF {
+			t.Errorf("closed with %s", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker not closed")
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestUDPDatagram] */
+func TestUDPDatagram(t *testing.T) {
+	upward := make(chan *engine.Message, 1)
+	server := NewUDPServer("127.0.0.1:0", AccessRequest, DefaultUDPOptions)
+	server.OnMessage = func(worker *SlaterWorker, msg *engine.Message) error {
+		upward <- msg
+		return nil
+	}
+
+	startTestServer(t, server, server.Listener)
+	defer server.Stop()
+
+	client, conn := udpClient(t, server.Listener.ListenAddr().String(), 9, nil)
+	defer conn.Close()
+
+	downward := make(chan []byte, 1)
+	client.OnDatagram(func(data []byte) {
+		downward <- data
+	})
+
+	// Session created by the first stream segment
+	ping := []byte{engine.MsgTypePing << 4, 0, 0, 0, 0}
+	client.Write(ping)
+	readFrames(t, client, 1)
+
+	// Ping in datagram, Pong by stream
+	if err := client.WriteDatagram(ping); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := readFrames(t, client, 1)[0]; msg.Type != engine.MsgTypePong {
+		t.Fatalf("got type %d, want pong", msg.Type)
+	}
+
+	// Unreliable upward message handled without acknowledgement
+	frame := []byte{engine.MsgVersionExtended, engine.MsgTypeUpward, engine.MsgSerializeRaw, engine.MsgCompressNone}
+	frame = binary.BigEndian.AppendUint16(frame, engine.MsgFlagUnreliable)
+	frame = binary.BigEndian.AppendUint32(frame, 5)
+	frame = append(frame, "hello"...)
+	if err := client.WriteDatagram(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-upward:
+		if msg.Flags&engine.MsgFlagUnreliable == 0 || string(msg.Body.Payload) != "hello" {
+			t.Errorf("got flags %d, payload %q", msg.Flags, msg.Body.Payload)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("datagram not processed")
+	}
+
+	// Unreliable downward message
+	msg := engine.NewMessage(nil)
+	msg.Type = engine.MsgTypeDownward
+	msg.SerializeMode = engine.MsgSerializeRaw
+	msg.Flags = engine.MsgFlagUnreliable
+	msg.Body.Payload = []byte("world")
+	server.Workers.Workers()[0].WriteMessage(msg)
+	select {
+	case data := <-downward:
+		ret := readFrames(t, bytes.NewBuffer(data), 1)[0]
+		if ret.Sequence != 0 || string(ret.Body.Payload) != "world" {
+			t.Errorf("got sequence %d, payload %q", ret.Sequence, ret.Body.Payload)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("datagram not received")
+	}
+}
+
+/* }}} */
+
+// rawSegment : Segment header without data
+func rawSegment(conv uint32, cmd byte, sn uint32) []byte {
+	seg := make([]byte, arqHeaderLength)
+	binary.BigEndian.PutUint32(seg[0:4], conv)
+	seg[4] = cmd
+	binary.BigEndian.PutUint16(seg[5:7], 128)
+	binary.BigEndian.PutUint32(seg[11:15], sn)
+
+	return seg
+}
+
+/* {{{ [TestUDPNewSession] */
+func TestUDPNewSession(t *testing.T) {
+	opts := DefaultUDPOptions
+	opts.MaxSessions = 2
+	server := NewUDPServer("127.0.0.1:0", AccessRequest, opts)
+	startTestServer(t, server, server.Listener)
+	defer server.Stop()
+
+	addr := server.Listener.ListenAddr().(*net.UDPAddr)
+	cases := []struct {
+		name     string
+		segment  []byte
+		sessions int
+	}{
+		{"ack of unknown conversation", rawSegment(1, arqCmdAck, 0), 0},
+		{"datagram of unknown conversation", rawSegment(2, arqCmdDatagram, 0), 0},
+		{"push not from start", rawSegment(3, arqCmdPush, 5), 0},
+		{"short datagram", rawSegment(4, arqCmdPush, 0)[:arqHeaderLength-1], 0},
+		{"first push", rawSegment(5, arqCmdPush, 0), 1},
+		{"first push again", rawSegment(5, arqCmdPush, 0), 1},
+		{"another conversation", rawSegment(6, arqCmdPush, 0), 2},
+		{"max sessions", rawSegment(7, arqCmdPush, 0), 2},
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	ul := server.Listener.(*udpListener)
+	for _, c := range cases {
+		conn.Write(c.segment)
+		time.Sleep(50 * time.Millisecond)
+
+		ul.lock.Lock()
+		n := len(ul.sessions)
+		ul.lock.Unlock()
+		if n != c.sessions || server.Workers.Count() != c.sessions {
+			t.Errorf("%s : %d sessions, %d workers, want %d", c.name, n, server.Workers.Count(), c.sessions)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestUDPSessionTimeout] */
+func TestUDPSessionTimeout(t *testing.T) {
+	closed := make(chan *CloseReason, 1)
+	opts := DefaultUDPOptions
+	opts.Timeout = 200 * time.Millisecond
+	server := NewUDPServer("127.0.0.1:0", AccessRequest, opts)
+	server.OnClose = func(worker *SlaterWorker, reason *CloseReason) error {
+		closed <- reason
+		return nil
+	}
+
+	startTestServer(t, server, server.Listener)
+	defer server.Stop()
+
+	conn, err := net.DialUDP("udp", nil, server.Listener.ListenAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// The first push only, never acknowledged by client
+	conn.Write(rawSegment(1, arqCmdPush, 0))
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("silent session not closed")
+	}
+
+	ul := server.Listener.(*udpListener)
+	ul.lock.Lock()
+	n := len(ul.sessions)
+	ul.lock.Unlock()
+	if n != 0 {
+		t.Errorf("%d sessions left", n)
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestARQInputLimits] */
+func TestARQInputLimits(t *testing.T) {
+	opts := DefaultUDPOptions
+	opts.RcvWnd = 4
+	opts.MTU = arqHeaderLength + 10
+	s := newARQSession(1, opts, func(data []byte) error { return nil }, nil)
+
+	push := func(sn uint32, length int) error {
+		seg := rawSegment(1, arqCmdPush, sn)
+		binary.BigEndian.PutUint16(seg[19:21], uint16(length))
+
+		return s.input(append(seg, make([]byte, length)...))
+	}
+
+	if err := push(0, s.mss+1); err == nil {
+		t.Error("segment larger than mss accepted")
+	}
+
+	// Nothing read, pushes dropped once a window queued
+	for sn := uint32(0); sn < 8; sn++ {
+		if err := push(sn, s.mss); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rcvNxt != uint32(opts.RcvWnd) || s.rcvQueue.Len() != opts.RcvWnd*s.mss {
+		t.Errorf("rcvNxt %d, queued %d bytes", s.rcvNxt, s.rcvQueue.Len())
+	}
+
+	if len(s.acks) != opts.RcvWnd {
+		t.Errorf("%d segments acknowledged", len(s.acks))
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
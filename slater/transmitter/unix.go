@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// UnixOptions : Permission of UNIX socket file
+type UnixOptions struct {
+	// Mode : File mode of socket, umask applied if 0
+	Mode os.FileMode
+
+	// UID / GID : Owner of socket, -1 to keep unchanged (as os.Chown)
+	UID int
+	GID int
+}
+
+// DefaultUnixOptions : Read / write by owner and group
+var DefaultUnixOptions = UnixOptions{
+	Mode: 0660,
+	UID:  -1,
+	GID:  -1,
+}
+
+// listenUnix : Listen on UNIX socket, remove stale socket file left by
+// dead process first
+/* {{{ [listenUnix] */
+func listenUnix(path string, opts UnixOptions) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+
+		if c, err := net.Dial("unix", path); err == nil {
+			// Someone alive
+			c.Close()
+			return nil, fmt.Errorf("%s already in use", path)
+		}
+
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Remove stale socket %s failed : %s", path, err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Mode != 0 {
+		if err = os.Chmod(path, opts.Mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	if opts.UID != -1 || opts.GID != -1 {
+		if err = os.Chown(path, opts.UID, opts.GID); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+/* }}} */
+
+// NewUnixServer : Create a new UNIX domain socket server, addr is the
+// path of socket file, removed on server stop
+/* {{{ [NewUnixServer] Create UNIX server */
+func NewUnixServer(addr string, handler HandlerFunc, opts UnixOptions) *SlaterServer {
+	return &SlaterServer{
+		Addr:    addr,
+		Handler: handler,
+		Listener: &netListener{
+			F: func(addr string) (net.Listener, error) {
+				return listenUnix(addr, opts)
+			},
+		},
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* {{{ [TestListenUnix] */
+func TestListenUnix(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(path string) func()
+		fail  bool
+	}{
+		{"no file", func(path string) func() { return func() {} }, false},
+		{"regular file", func(path string) func() {
+			os.WriteFile(path, nil, 0600)
+			return func() {}
+		}, true},
+		{"stale socket", func(path string) func() {
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Left by dead process
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			l.Close()
+
+			return func() {}
+		}, false},
+		{"live socket", func(path string) func() {
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return func() { l.Close() }
+		}, true},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "slater.sock")
+		cleanup := c.setup(path)
+		l, err := listenUnix(path, UnixOptions{Mode: 0600, UID: -1, GID: -1})
+		cleanup()
+		if c.fail {
+			if err == nil {
+				l.Close()
+				t.Errorf("%s : error expected", c.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s : %s", c.name, err)
+			continue
+		}
+
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s : socket file %v, %v", c.name, fi, err)
+		}
+
+		l.Close()
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestUnixServer] */
+func TestUnixServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slater.sock")
+	connected := make(chan *SlaterWorker, 2)
+	server := NewUnixServer(path, AccessRequest, DefaultUnixOptions)
+	server.OnConnect = func(worker *SlaterWorker) error {
+		connected <- worker
+		return nil
+	}
+
+	startTestServer(t, server, server.Listener)
+
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+		if !pingPong(conn) {
+			t.Errorf("client %d : no pong", i)
+		}
+
+		addrs = append(addrs, (<-connected).Addr)
+	}
+
+	if addrs[0] == addrs[1] || server.Workers.GetByAddr(addrs[1]) == nil {
+		t.Errorf("client addresses %v", addrs)
+	}
+
+	server.Stop()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after stop : %v", err)
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/drnp/slater/slater/engine"
+	"github.com/gorilla/websocket"
+)
+
+// errListenerClosed : Accept on closed listener
+var errListenerClosed = errors.New("Listener closed")
+
+// wsConn : Binary messages of WebSocket as byte stream. Message framing
+// not aligned with WebSocket messages, one message may carry several
+// (or part of) slater frames
+/* {{{ [wsConn] */
+type wsConn struct {
+	ws        *websocket.Conn
+	r         io.Reader
+	writeLock sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			t, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+
+				return 0, err
+			}
+
+			if websocket.BinaryMessage != t {
+				return 0, errors.New("Only binary WebSocket message supported")
+			}
+
+			c.r = r
+		}
+
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			// Next message
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+/* }}} */
+
+// wsListener : WebSocketServer listener, HTTP connections upgraded on
+// Path, others answered 404
+/* {{{ [wsListener] */
+type wsListener struct {
+	proxyOption
+	Path     string
+	Upgrader websocket.Upgrader
+	L        net.Listener
+
+	server    *http.Server
+	connChan  chan *wsConn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func (wl *wsListener) Init(addr string) (err error) {
+	fmt.Printf("Listen on addr (WebSocket) : %s%s\n", addr, wl.Path)
+	wl.L, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	wl.L = wl.wrap(wl.L)
+
+	wl.connChan = make(chan *wsConn)
+	wl.closeChan = make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(wl.Path, wl.upgrade)
+	wl.server = &http.Server{Handler: mux}
+	go wl.server.Serve(wl.L)
+
+	return
+}
+
+// upgrade : Hand upgraded connection over to Accept
+func (wl *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	ws, err := wl.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Response already written by upgrader
+		return
+	}
+
+	if engine.MaxBodyLength > 0 {
+		// Whole frame with the largest header
+		ws.SetReadLimit(int64(engine.MaxBodyLength) + engine.MsgHeaderLengthExtended + 4)
+	}
+
+	select {
+	case wl.connChan <- &wsConn{ws: ws}:
+	case <-wl.closeChan:
+		ws.Close()
+	}
+}
+
+func (wl *wsListener) Accept() (conn io.ReadWriteCloser, clientAddr string, err error) {
+	select {
+	case c := <-wl.connChan:
+		return c, c.ws.RemoteAddr().String(), nil
+	case <-wl.closeChan:
+		return nil, "", errListenerClosed
+	}
+}
+
+func (wl *wsListener) Close() error {
+	wl.closeOnce.Do(func() {
+		close(wl.closeChan)
+	})
+
+	// Hijacked (upgraded) connections not affected
+	return wl.server.Close()
+}
+
+func (wl *wsListener) ListenAddr() net.Addr {
+	if wl.L != nil {
+		return wl.L.Addr()
+	}
+
+	return nil
+}
+
+/* }}} */
+
+// checkOrigin : Allow listed origins, "*" for any
+/* {{{ [checkOrigin] */
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Not browser
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+
+		for _, allowed := range origins {
+			if allowed == "*" || allowed == origin || allowed == u.Host {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+/* }}} */
+
+// NewWebSocketServer : Create a new WebSocket server, clients connect to
+// ws://addr/path. Cross-origin requests rejected if origins empty
+/* {{{ [NewWebSocketServer] Create WebSocket server */
+func NewWebSocketServer(addr, path string, handler HandlerFunc, origins []string) *SlaterServer {
+	if path == "" {
+		path = "/"
+	}
+
+	l := &wsListener{
+		Path: path,
+	}
+
+	if len(origins) > 0 {
+		l.Upgrader.CheckOrigin = checkOrigin(origins)
+	}
+
+	return &SlaterServer{
+		Addr:     addr,
+		Handler:  handler,
+		Listener: l,
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+	"github.com/gorilla/websocket"
+)
+
+/* {{{ [TestCheckOrigin] */
+func TestCheckOrigin(t *testing.T) {
+	cases := []struct {
+		origins []string
+		origin  string
+		ok      bool
+	}{
+		{[]string{"game.example.com"}, "", true},
+		{[]string{"game.example.com"}, "https://game.example.com", true},
+		{[]string{"https://game.example.com"}, "https://game.example.com", true},
+		{[]string{"game.example.com"}, "https://evil.example.com", false},
+		{[]string{"*"}, "https://evil.example.com", true},
+		{[]string{"game.example.com"}, "://", false},
+	}
+
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+
+		if ok := checkOrigin(c.origins)(r); ok != c.ok {
+			t.Errorf("%v %q : got %v", c.origins, c.origin, ok)
+		}
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestWebSocketServer] */
+func TestWebSocketServer(t *testing.T) {
+	server := NewWebSocketServer("127.0.0.1:0", "/slater", AccessRequest, []string{"game.example.com"})
+	startTestServer(t, server, server.Listener)
+	defer server.Stop()
+
+	base := "ws://" + server.Listener.ListenAddr().String()
+	cases := []struct {
+		name   string
+		path   string
+		origin string
+		ok     bool
+	}{
+		{"not browser", "/slater", "", true},
+		{"allowed origin", "/slater", "http://game.example.com", true},
+		{"other origin", "/slater", "http://evil.example.com", false},
+		{"other path", "/other", "", false},
+	}
+
+	for _, c := range cases {
+		header := http.Header{}
+		if c.origin != "" {
+			header.Set("Origin", c.origin)
+		}
+
+		ws, _, err := websocket.DefaultDialer.Dial(base+c.path, header)
+		if (err == nil) != c.ok {
+			t.Errorf("%s : dial error %v", c.name, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		// Frame split over two binary messages
+		ws.SetReadDeadline(time.Now().Add(testTimeout))
+		ws.WriteMessage(websocket.BinaryMessage, []byte{engine.MsgTypePing << 4, 0})
+		ws.WriteMessage(websocket.BinaryMessage, []byte{0, 0, 0})
+		typ, data, err := ws.ReadMessage()
+		if err != nil || typ != websocket.BinaryMessage || len(data) != 5 || data[0]>>4 != engine.MsgTypePong {
+			t.Errorf("%s : got %d %v %v", c.name, typ, data, err)
+		}
+
+		// Text message closes connection
+		ws.WriteMessage(websocket.TextMessage, []byte("ping"))
+		if _, _, err = ws.ReadMessage(); err == nil {
+			t.Errorf("%s : connection alive after text message", c.name)
+		}
+
+		ws.Close()
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */
@@ -32,23 +32,64 @@ package transmitter
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/drnp/slater/slater/engine"
 	"github.com/drnp/slater/slater/runtime/utils"
 )
 
+// datagramBacklog : Datagrams waiting for process, dropped beyond
+const datagramBacklog = 64
+
+// Online errors
+var (
+	// ErrUIDRebound : Worker kicked since its UID bound by a new connection
+	ErrUIDRebound = errors.New("UID bound by another connection")
+	// ErrOnlineFailures : Online attempts exceeded OnlineMaxFailures
+	ErrOnlineFailures = errors.New("Too many failed Online attempts")
+)
+
 // SlaterWorker : Client worker of network server
 type SlaterWorker struct {
+	ID         uint64
 	Addr       string
-	UID        uint64
+	Version    byte
 	conn       io.ReadWriteCloser
 	recvBuffer *bytes.Buffer
-	sendBuffer *bytes.Buffer
+	sendQueue  *sendQueue
 	recvChan   chan struct{}
-	sendChan   chan int
 	closeChan  chan struct{}
 	server     *SlaterServer
+
+	// processLock : Serialize process of stream and datagram messages
+	processLock sync.Mutex
+
+	// Login state, protect Version, uid, isOnline and onlineFailures.
+	// uid written by registry only
+	stateLock      sync.RWMutex
+	uid            uint64
+	isOnline       bool
+	onlineFailures int
+
+	// Reliable delivery
+	sequence    uint32
+	pending     map[uint32]*pendingMessage
+	pendingLock sync.Mutex
+
+	// Timestamps (UnixNano) of last data and heartbeat received
+	lastRecv      int64
+	lastHeartbeat int64
+
+	// Close state
+	closeLock   sync.Mutex
+	closed      bool
+	closeReason *CloseReason
 }
 
 // Drive : Start worker
@@ -65,29 +106,35 @@ func (worker *SlaterWorker) Drive() error {
 		var n int
 		var msg *engine.Message
 		logger := utils.NewLogger("SLATER WORKER: ")
+		defer worker.finish(logger)
+		defer worker.recoverPanic(logger)
 
 	loop:
 		for {
 			buf := make([]byte, 4096)
 			n, err = worker.conn.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					// Read error
-					logger.Println("Socket read error")
-				} else {
-					// Worker closed
-					if worker.server != nil && worker.server.OnClose != nil {
-						worker.server.OnClose(worker)
-					}
+			if n > 0 {
+				worker.touchRecv()
+			}
 
-					close(worker.closeChan)
-					break loop
+			if err != nil {
+				if err == io.EOF {
+					// Closed by client
+					worker.closeWith(CloseEOF, nil)
+				} else if !worker.isClosed() {
+					// Read error, never retry on broken socket
+					logger.Printf("Client %s : Socket read error : %s\n", worker.Addr, err.Error())
+					worker.closeWith(CloseReadError, err)
 				}
+
+				break loop
 			} else {
 				n, err = worker.recvBuffer.Write(buf[:n])
 				if err != nil {
 					// Write buffer error
 					logger.Println("Buffer write error")
+					worker.closeWith(CloseReadError, err)
+					break loop
 				} else {
 					if worker.server != nil {
 					TryMsg:
@@ -96,20 +143,16 @@ func (worker *SlaterWorker) Drive() error {
 								msg = engine.NewMessage(worker.recvBuffer)
 							}
 
-							ret, _ := msg.Parse()
+							ret, err := msg.Parse()
+							if err != nil {
+								// Broken stream, drop connection
+								logger.Printf("Client %s : %s\n", worker.Addr, err.Error())
+								worker.closeWith(CloseProtocolError, err)
+								break loop
+							}
+
 							if ret {
-								if engine.MsgTypePing == msg.Type {
-									// Ping - Pong
-									//logger.Println("Access ping")
-									pong := engine.NewMessage(nil)
-									pong.Type = engine.MsgTypePong
-									worker.WriteMessage(pong)
-								} else if worker.server.OnMessage != nil {
-									err = worker.server.OnMessage(worker, msg)
-                                    if err != nil {
-                                        logger.Printf("OnMessage error: %s\n", err.Error());
-                                    }
-								}
+								worker.process(msg, logger)
 								msg = nil
 							} else {
 								break TryMsg
@@ -124,46 +167,96 @@ func (worker *SlaterWorker) Drive() error {
 		}
 	}()
 
+	// Unreliable frames received out of stream
+	if dc, ok := worker.conn.(datagramConn); ok && worker.server != nil {
+		datagramChan := make(chan []byte, datagramBacklog)
+		dc.OnDatagram(func(data []byte) {
+			select {
+			case datagramChan <- data:
+			default:
+				// Unreliable anyway
+			}
+		})
+
+		go worker.readDatagrams(datagramChan)
+	}
+
+	// Retransmit
+	if worker.server != nil && worker.server.AckTimeout > 0 {
+		go worker.retransmit()
+	}
+
+	// Idle / heartbeat
+	if worker.server != nil && (worker.server.IdleTimeout > 0 ||
+		worker.server.HeartbeatTimeout > 0 || worker.server.PingInterval > 0) {
+		go worker.watchdog()
+	}
+
 	// Writer
 	go func() {
 		var (
 			err   error
+			data  []byte
 			nData int
 			nSent int
 			n     int
 		)
-		//logger := utils.NewLogger("SLATER: ")
-		buf := make([]byte, 4096)
+		logger := utils.NewLogger("SLATER WORKER: ")
+		defer worker.sendQueue.discard()
+		defer worker.recoverPanic(logger)
+		batch := make([]byte, 0, maxCoalesceSize)
 
-	loop:
 		for {
-			<-worker.sendChan
-			if worker.sendBuffer.Len() > 0 {
-				nData, _ = worker.sendBuffer.Read(buf)
-				nSent = 0
-				// Write out
-				for nSent < nData {
-					n, err = worker.conn.Write(buf[:nData])
-					if err != nil {
-						if err == io.EOF {
-							// Nothing to read
-							break loop
-						} else {
-							// Error
-						}
-					} else {
-						// Data sent
-						nSent += n
-					}
+			select {
+			case <-worker.closeChan:
+				return
+			case data = <-worker.sendQueue.ch:
+			}
+
+			// Coalesce queued frames into one write
+			batch = append(batch[:0], data...)
+			nData = 1
+		coalesce:
+			for len(batch) < maxCoalesceSize {
+				select {
+				case data = <-worker.sendQueue.ch:
+					batch = append(batch, data...)
+					nData++
+				default:
+					break coalesce
 				}
 			}
+
+			// Write out, conn may accept part of data
+			for nSent = 0; nSent < len(batch); nSent += n {
+				n, err = worker.conn.Write(batch[nSent:])
+				if err != nil {
+					break
+				}
+			}
+
+			worker.sendQueue.sent(nData)
+
+			if cap(batch) > maxCoalesceSize {
+				// Do not hold huge buffer
+				batch = make([]byte, 0, maxCoalesceSize)
+			}
+
+			if err != nil {
+				if !worker.isClosed() {
+					logger.Printf("Client %s : Socket write error : %s\n", worker.Addr, err.Error())
+				}
+
+				worker.closeWith(CloseWriteError, err)
+
+				return
+			}
 		}
 	}()
 
 loop:
 	for {
 		select {
-		//case <-worker.sendChan:
 		case <-worker.closeChan:
 			break loop
 		}
@@ -174,21 +267,309 @@ loop:
 
 /* }}} */
 
-// WriteRaw : Send data from worker
-/* {{{ [Write] Send data */
-func (worker *SlaterWorker) WriteRaw(data []byte) error {
-	if worker == nil {
-		return errors.New("Invalid worker object")
+// readDatagrams : Process frames carried by unreliable datagrams, each
+// datagram holds complete frames only
+/* {{{ [readDatagrams] */
+func (worker *SlaterWorker) readDatagrams(datagramChan chan []byte) {
+	logger := utils.NewLogger("SLATER WORKER: ")
+	defer worker.recoverPanic(logger)
+
+	for {
+		select {
+		case <-worker.closeChan:
+			return
+		case data := <-datagramChan:
+			worker.touchRecv()
+			buf := bytes.NewBuffer(data)
+			for buf.Len() > 0 {
+				msg := engine.NewMessage(buf)
+				ret, err := msg.Parse()
+				if err != nil {
+					logger.Printf("Client %s : %s\n", worker.Addr, err.Error())
+					worker.closeWith(CloseProtocolError, err)
+					return
+				}
+
+				if !ret {
+					logger.Printf("Client %s : Incomplete frame in datagram dropped\n", worker.Addr)
+					break
+				}
+
+				worker.process(msg, logger)
+			}
+		}
 	}
+}
+
+/* }}} */
+
+// process : Process a complete message from client. Messages from stream
+// and datagrams are processed one by one
+/* {{{ [process] */
+func (worker *SlaterWorker) process(msg *engine.Message, logger *log.Logger) {
+	var err error
+	atomic.AddInt64(&worker.server.inflight, 1)
+	defer atomic.AddInt64(&worker.server.inflight, -1)
+	worker.processLock.Lock()
+	defer worker.processLock.Unlock()
+	defer worker.recoverPanic(logger)
+
+	if engine.MsgTypePing == msg.Type {
+		// Ping - Pong
+		//logger.Println("Access ping")
+		worker.touchHeartbeat()
+		pong := engine.NewMessage(nil)
+		pong.Type = engine.MsgTypePong
+		worker.WriteMessage(pong)
+	} else if engine.MsgTypePong == msg.Type {
+		// Answer of server-initiated ping
+		worker.touchHeartbeat()
+	} else if engine.MsgTypeOnline == msg.Type {
+		// Login
+		err = worker.online(msg)
+		if err != nil {
+			logger.Printf("Client %s online failed : %s\n", worker.Addr, err.Error())
+		}
+	} else if engine.MsgTypeOffline == msg.Type {
+		// Logout
+		worker.offline(msg)
+	} else if engine.MsgTypeDownwardAck == msg.Type {
+		worker.ack(msg.Sequence)
+	} else if worker.server.RequireOnline && !worker.IsOnline() {
+		logger.Printf("Client %s not online, message dropped\n", worker.Addr)
+	} else if worker.server.onMessage != nil {
+		err = worker.server.onMessage(worker, msg)
+		if err != nil {
+			logger.Printf("OnMessage error: %s\n", err.Error())
+		} else if engine.MsgTypeUpward == msg.Type && 0 == msg.Flags&engine.MsgFlagUnreliable {
+			// Acknowledge
+			ack := engine.NewMessage(nil)
+			ack.Type = engine.MsgTypeUpwardAck
+			ack.Sequence = msg.Sequence
+			worker.WriteMessage(ack)
+		}
+	}
+}
+
+/* }}} */
 
-	size, err := worker.sendBuffer.Write(data)
+// recoverPanic : Recover panic in worker goroutine (or user handler called
+// by it), only the connection of worker will be closed
+/* {{{ [recoverPanic] */
+func (worker *SlaterWorker) recoverPanic(logger *log.Logger) {
+	if r := recover(); r != nil {
+		logger.Printf("Client %s (UID %d) panic : %v\n%s", worker.Addr, worker.UID(), r, debug.Stack())
+		worker.closeWith(CloseInternal, fmt.Errorf("Worker panic : %v", r))
+	}
+}
+
+/* }}} */
+
+// finish : Worker reader exited, call OnClose. Reader is the only one
+// calling it, so OnClose called exactly once
+/* {{{ [finish] */
+func (worker *SlaterWorker) finish(logger *log.Logger) {
+	defer close(worker.closeChan)
+	defer worker.recoverPanic(logger)
+
+	// Every exit path of reader sets reason, just in case
+	worker.closeWith(CloseInternal, nil)
+	if worker.server != nil {
+		worker.server.Workers.remove(worker)
+		if worker.server.OnClose != nil {
+			worker.server.OnClose(worker, worker.CloseReason())
+		}
+	}
+}
+
+/* }}} */
+
+// online : Process Online message, bind UID and send OnlineAck back
+/* {{{ [online] */
+func (worker *SlaterWorker) online(msg *engine.Message) error {
+	// Header version negotiation
+	version := msg.Version
+	if version > engine.MsgVersionCurrent {
+		version = engine.MsgVersionCurrent
+	}
+
+	worker.stateLock.Lock()
+	worker.Version = version
+	failures := worker.onlineFailures
+	worker.stateLock.Unlock()
+	if max := worker.server.OnlineMaxFailures; max > 0 && failures >= max {
+		// Being closed
+		return ErrOnlineFailures
+	}
+
+	authenticate := worker.server.Authenticate
+	if authenticate == nil {
+		authenticate = DefaultAuthenticate
+	}
+
+	ack := engine.NewMessage(nil)
+	ack.Type = engine.MsgTypeOnlineAck
+	ack.SerializeMode = msg.SerializeMode
+	ack.Body.App = msg.Body.App
+	uid, err := authenticate(worker, msg)
 	if err != nil {
+		// UID list of ack left empty, reason in payload
+		cmd := &engine.CommonCommand{
+			Params: map[string]interface{}{
+				"error": err.Error(),
+			},
+		}
+		ack.Body.Payload, _ = cmd.Encode(msg.SerializeMode)
+		worker.WriteMessage(ack)
+
+		worker.stateLock.Lock()
+		worker.onlineFailures++
+		failures := worker.onlineFailures
+		worker.stateLock.Unlock()
+		if failures == worker.server.OnlineMaxFailures {
+			// Let client read the reason
+			go worker.closeFlushed(CloseUnauthorized, err)
+		}
+
 		return err
 	}
 
-	worker.sendChan <- size
+	prev := worker.server.Workers.bind(worker, uid)
+	if prev != nil {
+		// Only one connection per UID
+		prev.closeWith(CloseKick, ErrUIDRebound)
+	}
 
-	return nil
+	worker.stateLock.Lock()
+	worker.isOnline = true
+	worker.onlineFailures = 0
+	worker.stateLock.Unlock()
+	ack.Body.UID = []int64{int64(uid)}
+
+	return worker.WriteMessage(ack)
+}
+
+/* }}} */
+
+// offline : Process Offline message, unbind UID and send OfflineAck back.
+// Connection will be closed by client
+/* {{{ [offline] */
+func (worker *SlaterWorker) offline(msg *engine.Message) error {
+	worker.stateLock.Lock()
+	worker.isOnline = false
+	worker.stateLock.Unlock()
+	worker.server.Workers.bind(worker, 0)
+
+	ack := engine.NewMessage(nil)
+	ack.Type = engine.MsgTypeOfflineAck
+	ack.SerializeMode = msg.SerializeMode
+
+	return worker.WriteMessage(ack)
+}
+
+/* }}} */
+
+// UID : User id bound by Online, 0 if not bound
+/* {{{ [UID] */
+func (worker *SlaterWorker) UID() uint64 {
+	worker.stateLock.RLock()
+	defer worker.stateLock.RUnlock()
+
+	return worker.uid
+}
+
+/* }}} */
+
+// IsOnline : Worker passed Online handshake
+/* {{{ [IsOnline] */
+func (worker *SlaterWorker) IsOnline() bool {
+	worker.stateLock.RLock()
+	defer worker.stateLock.RUnlock()
+
+	return worker.isOnline
+}
+
+/* }}} */
+
+// Close : Kick worker by application, err passed to OnClose handler
+// as Err of CloseReason
+/* {{{ [Close] Close worker */
+func (worker *SlaterWorker) Close(err error) error {
+	if worker == nil {
+		return errors.New("Invalid worker object")
+	}
+
+	return worker.closeWith(CloseKick, err)
+}
+
+/* }}} */
+
+// closeWith : Close connection of worker, the first reason wins
+/* {{{ [closeWith] */
+func (worker *SlaterWorker) closeWith(code CloseCode, err error) error {
+	worker.closeLock.Lock()
+	defer worker.closeLock.Unlock()
+	if worker.closed {
+		return nil
+	}
+
+	worker.closed = true
+	worker.closeReason = &CloseReason{
+		Code: code,
+		Err:  err,
+	}
+
+	err = worker.conn.Close()
+
+	// Never written out
+	worker.sendQueue.discard()
+
+	return err
+}
+
+/* }}} */
+
+// closeFlushed : Close worker once queued data written out, or after
+// timeout of send queue at most
+/* {{{ [closeFlushed] */
+func (worker *SlaterWorker) closeFlushed(code CloseCode, err error) {
+	deadline := time.Now().Add(worker.sendQueue.timeout)
+	for worker.sendPending() > 0 && time.Now().Before(deadline) && !worker.isClosed() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	worker.closeWith(code, err)
+}
+
+/* }}} */
+
+// CloseReason : Reason of closing, nil if worker alive
+/* {{{ [CloseReason] */
+func (worker *SlaterWorker) CloseReason() *CloseReason {
+	worker.closeLock.Lock()
+	defer worker.closeLock.Unlock()
+
+	return worker.closeReason
+}
+
+/* }}} */
+
+// isClosed : Worker closed by server
+func (worker *SlaterWorker) isClosed() bool {
+	worker.closeLock.Lock()
+	defer worker.closeLock.Unlock()
+
+	return worker.closed
+}
+
+// WriteRaw : Send data from worker
+/* {{{ [Write] Send data */
+func (worker *SlaterWorker) WriteRaw(data []byte) error {
+	if worker == nil {
+		return errors.New("Invalid worker object")
+	}
+
+	return worker.enqueue(data)
 }
 
 /* }}} */
@@ -196,29 +577,100 @@ func (worker *SlaterWorker) WriteRaw(data []byte) error {
 // WriteMessage : Send engine.CommonCommand
 /* {{{ [WriteMessage] Send command */
 func (worker *SlaterWorker) WriteMessage(msg *engine.Message) error {
+	return worker.writeMessage(msg, true)
+}
+
+/* }}} */
+
+// writeMessage : Stream message and put into send queue, by enqueueAsync
+// if caller cannot wait for full queue
+/* {{{ [writeMessage] */
+func (worker *SlaterWorker) writeMessage(msg *engine.Message, wait bool) error {
 	logger := utils.NewLogger("SLATER SEND MESSAGE: ")
-    if msg == nil {
-        logger.Println("Invalid message object");
+	if msg == nil {
+		logger.Println("Invalid message object")
 		return errors.New("Invalid message object")
 	}
 
-	data, _ := msg.Stream()
+	// Stream with negotiated header version
+	m := *msg
+	worker.stateLock.RLock()
+	m.Version = worker.Version
+	worker.stateLock.RUnlock()
+
+	// Unreliable message never sequenced (acknowledged)
+	dc, unreliable := worker.conn.(datagramConn)
+	unreliable = unreliable && 0 != m.Flags&engine.MsgFlagUnreliable
+	if engine.MsgTypeDownward == m.Type && engine.MsgVersionLegacy != m.Version && !unreliable {
+		m.Sequence = worker.nextSequence()
+	}
+
+	data, err := m.Stream()
+	if err != nil {
+		logger.Println(err.Error())
+		return err
+	}
+
+	if unreliable {
+		err = dc.WriteDatagram(data)
+		if err != errDatagramTooLarge {
+			if err != nil {
+				logger.Println(err.Error())
+			}
+
+			return err
+		}
+
+		// Too large for one datagram, reliable stream instead
+		if engine.MsgTypeDownward == m.Type && engine.MsgVersionLegacy != m.Version {
+			m.Sequence = worker.nextSequence()
+			data, err = m.Stream()
+			if err != nil {
+				logger.Println(err.Error())
+				return err
+			}
+		}
+	}
+
+	if 0 != m.Sequence && engine.MsgTypeDownward == m.Type &&
+		worker.server != nil && worker.server.AckTimeout > 0 {
+		// Wait for DownwardAck
+		worker.track(m.Sequence, data)
+	}
+
 	//fmt.Printf("Sending :\n%#v\n", data)
 	utils.DebugByteArray(data)
-	size, err := worker.sendBuffer.Write(data)
+	if wait {
+		err = worker.enqueue(data)
+	} else {
+		err = worker.enqueueAsync(data)
+	}
+
 	if err != nil {
-        logger.Println(err.Error())
+		logger.Println(err.Error())
 		return err
 	}
 
-    logger.Printf("Send %d bytes to langer\n", size)
-	worker.sendChan <- size
+	logger.Printf("Send %d bytes to langer\n", len(data))
 
 	return nil
 }
 
 /* }}} */
 
+// sendPending : Amount of data in backlog, queued or being written.
+// Nothing to flush once worker closed
+/* {{{ [sendPending] */
+func (worker *SlaterWorker) sendPending() int {
+	if worker.isClosed() {
+		return 0
+	}
+
+	return int(atomic.LoadInt64(&worker.sendQueue.pending)) + worker.sendQueue.backlogLen()
+}
+
+/* }}} */
+
 // ReadAll : Read all data from worker
 /* {{{ [ReadAll] */
 func (worker *SlaterWorker) ReadAll() ([]byte, error) {
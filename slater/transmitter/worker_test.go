@@ -0,0 +1,425 @@
+/*
+ * Copyright (c) 2016, 2017
+ *     PC-Game of Qihu.360. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ * 3. Neither the name of the University nor the names of its contributors
+ *    may be used to endorse or promote products derived from this software
+ *    without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE REGENTS AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE REGENTS OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package transmitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drnp/slater/slater/engine"
+)
+
+// testTimeout : Max wait of a test step
+const testTimeout = 2 * time.Second
+
+// testClient : Client end of a worker driven over net.Pipe
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	buffer *bytes.Buffer
+}
+
+// newTestWorker : Register and drive a worker of server, OnMessage
+// chained as serve does
+/* {{{ [newTestWorker] */
+func newTestWorker(t *testing.T, server *SlaterServer) (*SlaterWorker, *testClient) {
+	if server.OnMessage != nil && server.onMessage == nil {
+		server.onMessage = Chain(server.OnMessage, server.Middlewares...)
+	}
+
+	s, c := net.Pipe()
+	worker := NewWorker(server, s.RemoteAddr().String(), s)
+	server.Workers.add(worker)
+	go worker.Drive()
+
+	return worker, &testClient{t: t, conn: c, buffer: bytes.NewBuffer(nil)}
+}
+
+/* }}} */
+
+// send : Write extended frame (JSON serialized) to worker
+/* {{{ [testClient.send] */
+func (c *testClient) send(typ byte, seq uint32, body *engine.Body) {
+	var raw []byte
+	if body != nil {
+		raw, _ = body.Encode(engine.MsgSerializeJSON)
+	}
+
+	var flags uint16
+	if seq != 0 {
+		flags = engine.MsgFlagSequence
+	}
+
+	frame := []byte{engine.MsgVersionExtended, typ, engine.MsgSerializeJSON, engine.MsgCompressNone}
+	frame = binary.BigEndian.AppendUint16(frame, flags)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(raw)))
+	if seq != 0 {
+		frame = binary.BigEndian.AppendUint32(frame, seq)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write(append(frame, raw...)); err != nil {
+		c.t.Fatalf("client write : %s", err)
+	}
+}
+
+/* }}} */
+
+// recv : Read next frame from worker, nil if connection closed
+/* {{{ [testClient.recv] */
+func (c *testClient) recv() *engine.Message {
+	msg := engine.NewMessage(c.buffer)
+	buf := make([]byte, 4096)
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		ok, err := msg.Parse()
+		if err != nil {
+			c.t.Fatalf("client parse : %s", err)
+		}
+
+		if ok {
+			return msg
+		}
+
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				c.t.Fatal("client read : timeout")
+			}
+
+			return nil
+		}
+
+		c.buffer.Write(buf[:n])
+	}
+}
+
+/* }}} */
+
+// online : Send Online claiming uid and wait for OnlineAck
+/* {{{ [testClient.online] */
+func (c *testClient) online(uid int64) *engine.Message {
+	c.send(engine.MsgTypeOnline, 0, &engine.Body{App: "test", UID: []int64{uid}})
+	ack := c.recv()
+	if ack == nil || ack.Type != engine.MsgTypeOnlineAck {
+		c.t.Fatalf("OnlineAck expected, got %+v", ack)
+	}
+
+	return ack
+}
+
+/* }}} */
+
+// waitClosed : Wait for worker finished, returns close reason
+/* {{{ [waitClosed] */
+func waitClosed(t *testing.T, worker *SlaterWorker) *CloseReason {
+	select {
+	case <-worker.closeChan:
+	case <-time.After(testTimeout):
+		t.Fatal("worker not closed")
+	}
+
+	return worker.CloseReason()
+}
+
+/* }}} */
+
+// trustAuthenticate : Trust UID claimed by client
+func trustAuthenticate(worker *SlaterWorker, msg *engine.Message) (uint64, error) {
+	if len(msg.Body.UID) == 0 || msg.Body.UID[0] <= 0 {
+		return 0, ErrNoAuthenticator
+	}
+
+	return uint64(msg.Body.UID[0]), nil
+}
+
+/* {{{ [TestWorkerOnline] */
+func TestWorkerOnline(t *testing.T) {
+	cases := []struct {
+		name         string
+		authenticate AuthenticateHandler
+		maxFailures  int
+		uids         []int64
+		online       bool
+		reason       CloseCode
+	}{
+		{"default rejects", nil, 0, []int64{1, 2, 3}, false, 0},
+		{"trusted", trustAuthenticate, 0, []int64{5}, true, 0},
+		{"retry after failure", trustAuthenticate, 2, []int64{-1, 5}, true, 0},
+		{"too many failures", trustAuthenticate, 2, []int64{-1, -1}, false, CloseUnauthorized},
+		{"default too many failures", nil, 3, []int64{1, 2, 3}, false, CloseUnauthorized},
+	}
+
+	for _, c := range cases {
+		server := &SlaterServer{Authenticate: c.authenticate, OnlineMaxFailures: c.maxFailures}
+		worker, client := newTestWorker(t, server)
+		var ack *engine.Message
+		for _, uid := range c.uids {
+			ack = client.online(uid)
+		}
+
+		if c.reason != 0 {
+			if reason := waitClosed(t, worker); reason.Code != c.reason {
+				t.Errorf("%s : closed with %s", c.name, reason)
+			}
+
+			continue
+		}
+
+		if worker.IsOnline() != c.online || (len(ack.Body.UID) > 0) != c.online {
+			t.Errorf("%s : online %v, ack %+v", c.name, worker.IsOnline(), ack.Body)
+		}
+
+		if c.online && server.Workers.GetByUID(worker.UID()) != worker {
+			t.Errorf("%s : UID %d not bound", c.name, worker.UID())
+		}
+
+		client.conn.Close()
+		waitClosed(t, worker)
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestWorkerRebind] */
+func TestWorkerRebind(t *testing.T) {
+	server := &SlaterServer{Authenticate: trustAuthenticate}
+	first, c1 := newTestWorker(t, server)
+	second, c2 := newTestWorker(t, server)
+
+	c1.online(7)
+	c2.online(7)
+
+	reason := waitClosed(t, first)
+	if reason.Code != CloseKick || reason.Err != ErrUIDRebound {
+		t.Errorf("former worker closed with %s", reason)
+	}
+
+	if server.Workers.GetByUID(7) != second || server.Workers.CountOnline() != 1 {
+		t.Error("UID 7 not bound to the latest worker")
+	}
+
+	// Same worker again keeps its binding
+	c2.online(7)
+	if server.Workers.GetByUID(7) != second || second.isClosed() {
+		t.Error("online again unbound UID")
+	}
+
+	c2.conn.Close()
+	waitClosed(t, second)
+	if server.Workers.Count() != 0 || server.Workers.CountOnline() != 0 {
+		t.Errorf("registry not empty : %d / %d", server.Workers.Count(), server.Workers.CountOnline())
+	}
+}
+
+/* }}} */
+
+// recordConn : Connection recording data written, each write accepts
+// limit bytes at most (0 for all) after gate closed
+type recordConn struct {
+	lock      sync.Mutex
+	writes    [][]byte
+	limit     int
+	gate      chan struct{}
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newRecordConn(limit int) *recordConn {
+	return &recordConn{
+		limit:     limit,
+		gate:      make(chan struct{}),
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (rc *recordConn) Read(p []byte) (int, error) {
+	<-rc.closeChan
+
+	return 0, io.EOF
+}
+
+func (rc *recordConn) Write(p []byte) (int, error) {
+	select {
+	case <-rc.gate:
+	case <-rc.closeChan:
+		return 0, io.ErrClosedPipe
+	}
+
+	if rc.limit > 0 && len(p) > rc.limit {
+		p = p[:rc.limit]
+	}
+
+	rc.lock.Lock()
+	rc.writes = append(rc.writes, append([]byte{}, p...))
+	rc.lock.Unlock()
+
+	return len(p), nil
+}
+
+func (rc *recordConn) Close() error {
+	rc.closeOnce.Do(func() { close(rc.closeChan) })
+
+	return nil
+}
+
+// written : Sizes of writes and all data written
+func (rc *recordConn) written() ([]int, []byte) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	var sizes []int
+	var data []byte
+	for _, w := range rc.writes {
+		sizes = append(sizes, len(w))
+		data = append(data, w...)
+	}
+
+	return sizes, data
+}
+
+/* {{{ [TestWorkerWriter] */
+func TestWorkerWriter(t *testing.T) {
+	cases := []struct {
+		name   string
+		frames int
+		size   int
+		limit  int
+	}{
+		{"single", 1, 10, 0},
+		{"coalesced", 100, 1024, 0},
+		{"large frames", 4, maxCoalesceSize + 1, 0},
+		{"partial writes", 50, 300, 100},
+		{"partial coalesced", 200, 1024, 7000},
+	}
+
+	for _, c := range cases {
+		conn := newRecordConn(c.limit)
+		server := &SlaterServer{SendQueueSize: c.frames}
+		worker := NewWorker(server, c.name, conn)
+		go worker.Drive()
+
+		var want []byte
+		for i := 0; i < c.frames; i++ {
+			frame := bytes.Repeat([]byte{byte(i)}, c.size)
+			want = append(want, frame...)
+			if err := worker.WriteRaw(frame); err != nil {
+				t.Fatalf("%s : %s", c.name, err)
+			}
+		}
+
+		// Frames queued while the first write blocked
+		close(conn.gate)
+		deadline := time.Now().Add(testTimeout)
+		for worker.sendPending() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		sizes, data := conn.written()
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s : %d bytes written, want %d", c.name, len(data), len(want))
+		}
+
+		// Whole frames merged until batch reaches maxCoalesceSize
+		max := c.limit
+		if max == 0 {
+			max = maxCoalesceSize + c.size - 1
+			if c.size > maxCoalesceSize {
+				max = c.size
+			}
+		}
+
+		minWrites := (len(want) + max - 1) / max
+		if len(sizes) < minWrites || (c.limit == 0 && len(sizes) > c.frames) {
+			t.Errorf("%s : %d writes", c.name, len(sizes))
+		}
+
+		for _, n := range sizes {
+			if n > max {
+				t.Errorf("%s : write of %d bytes exceeds %d", c.name, n, max)
+			}
+		}
+
+		worker.Close(nil)
+		waitClosed(t, worker)
+	}
+}
+
+/* }}} */
+
+/* {{{ [TestWorkerWriteClose] */
+func TestWorkerWriteClose(t *testing.T) {
+	server := &SlaterServer{SendQueueSize: 16, SendQueueTimeout: 50 * time.Millisecond}
+	worker, client := newTestWorker(t, server)
+	go io.Copy(io.Discard, client.conn)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				err := worker.WriteMessage(downward(`"x"`))
+				if err != nil && err != ErrWorkerClosed && err != ErrQueueTimeout {
+					t.Errorf("write : %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	worker.Close(nil)
+	wg.Wait()
+
+	if reason := waitClosed(t, worker); reason.Code != CloseKick {
+		t.Errorf("closed with %s", reason)
+	}
+
+	if worker.sendPending() != 0 {
+		t.Errorf("pending %d after close", worker.sendPending())
+	}
+}
+
+/* }}} */
+
+/*
+ * Local variables:
+ * tab-width: 4
+ * c-basic-offset: 4
+ * End:
+ * vim600: sw=4 ts=4 fdm=marker
+ * vim<600: sw=4 ts=4
+ */